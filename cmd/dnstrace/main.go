@@ -3,50 +3,113 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/jaxxstorm/dnstrace/internal/dnsclient"
 	"github.com/jaxxstorm/dnstrace/internal/ladder"
+	"github.com/jaxxstorm/dnstrace/internal/model"
 	"github.com/jaxxstorm/dnstrace/internal/output"
 	"github.com/jaxxstorm/dnstrace/internal/trace"
+	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
 
 var Version = "dev"
 
+// commonTypes is the --all-common profile.
+var commonTypes = []string{"A", "AAAA", "MX", "TXT", "CAA", "HTTPS", "NS", "SOA"}
+
 type CLI struct {
-	Ladder LadderCmd `cmd:"" default:"withargs" help:"Resolver ladder trace (default)."`
-	Trace  TraceCmd  `cmd:"trace" help:"Authoritative delegation trace (root -> TLD -> authoritative)."`
+	Ladder  LadderCmd  `cmd:"" default:"withargs" help:"Resolver ladder trace (default)."`
+	Trace   TraceCmd   `cmd:"trace" help:"Authoritative delegation trace (root -> TLD -> authoritative)."`
+	Health  HealthCmd  `cmd:"dnssec-health" help:"Report DNSSEC signature windows and key state for each zone in the chain."`
 	Version VersionCmd `cmd:"version" help:"Print version."`
 }
 
 type LadderCmd struct {
-	FQDN      string        `arg:"" name:"fqdn" help:"Fully qualified domain name."`
-	RRType    string        `arg:"" name:"rrtype" enum:"A,AAAA,CNAME,TXT,MX,NS,SOA,SRV,PTR" optional:"" default:"A" help:"Record type to query."`
-	DNSSEC    bool          `help:"Set the DNSSEC DO bit."`
-	Transport string        `enum:"udp,tcp,auto" default:"auto" help:"Transport to use for queries."`
-	MaxTime   time.Duration `default:"2s" help:"Time budget per resolver."`
-	Output    string        `enum:"pretty,json" default:"pretty" help:"Output format."`
-	Resolvers []string      `name:"resolver" help:"Resolver IPs to query (repeatable). If not set, uses system resolvers."`
-	Verbose   bool          `help:"Enable verbose logging."`
-	Debug     bool          `help:"Enable debug logging (includes raw DNS messages)."`
+	FQDN       string        `arg:"" name:"fqdn" help:"Fully qualified domain name."`
+	RRType     string        `arg:"" name:"rrtype" enum:"A,AAAA,CNAME,TXT,MX,NS,SOA,SRV,PTR" optional:"" default:"A" help:"Record type to query."`
+	DNSSEC     bool          `help:"Set the DNSSEC DO bit."`
+	Transport  string        `enum:"udp,tcp,auto,dot,doh,doq" default:"auto" help:"Transport to use for queries."`
+	DoHMethod  string        `name:"doh-method" enum:"get,post" default:"post" help:"HTTP method for DoH queries."`
+	ECS        string        `name:"ecs" help:"Attach an EDNS Client Subnet option for this prefix (e.g. 203.0.113.0/24)."`
+	NSID       bool          `name:"nsid" help:"Request the server identifier (NSID) to see which anycast instance answered."`
+	Cookies    bool          `name:"cookies" help:"Send DNS cookies (RFC 7873) and report how each server handles them."`
+	Source     string        `name:"source" help:"Source IP or IP:port for outgoing queries. A port needs --transport udp or doq."`
+	Interface  string        `name:"interface" help:"Network interface to send queries from."`
+	ECSCompare []string      `name:"ecs-compare" help:"Query every resolver once per client subnet prefix and compare answers (repeatable)."`
+	TLS        TLSFlags      `embed:"" prefix:"tls-"`
+	MaxTime    time.Duration `default:"2s" help:"Time budget per resolver."`
+	Output     string        `enum:"pretty,json" default:"pretty" help:"Output format."`
+	Resolvers  []string      `name:"resolver" help:"Resolver IPs, DoH URLs such as https://dns.example/dns-query{?dns}, or quic://host:853 DoQ entries (repeatable). If not set, uses system resolvers."`
+	Verbose    bool          `help:"Enable verbose logging."`
+	Debug      bool          `help:"Enable debug logging (includes raw DNS messages)."`
 }
 
 type TraceCmd struct {
-	FQDN        string        `arg:"" name:"fqdn" help:"Fully qualified domain name."`
-	RRType      string        `arg:"" name:"rrtype" enum:"A,AAAA,CNAME,TXT,MX,NS,SOA,SRV,PTR" optional:"" default:"A" help:"Record type to query."`
-	DNSSEC      bool          `help:"Set the DNSSEC DO bit."`
-	Transport   string        `enum:"udp,tcp,auto" default:"auto" help:"Transport to use for queries."`
+	FQDN              string        `arg:"" name:"fqdn" help:"Fully qualified domain name."`
+	RRTypes           []string      `arg:"" name:"rrtype" optional:"" help:"Record types to query, comma or space separated (e.g. A,AAAA,MX); defaults to A. The delegation is traced once and the other types are asked of the final zone's servers."`
+	AllCommon         bool          `name:"all-common" help:"Query the common record types (A, AAAA, MX, TXT, CAA, HTTPS, NS, SOA) in one run instead of naming them."`
+	DNSSEC            bool          `help:"Set the DNSSEC DO bit and validate the chain of trust from the root."`
+	Transport         string        `enum:"udp,tcp,auto,dot" default:"auto" help:"Transport to use for queries."`
+	TLS               TLSFlags      `embed:"" prefix:"tls-"`
+	ECS               string        `name:"ecs" help:"Attach an EDNS Client Subnet option for this prefix (e.g. 203.0.113.0/24)."`
+	NSID              bool          `name:"nsid" help:"Request the server identifier (NSID) to see which anycast instance answered."`
+	Cookies           bool          `name:"cookies" help:"Send DNS cookies (RFC 7873) and report how each server handles them."`
+	QNameMin          bool          `name:"qname-min" help:"Minimise query names (RFC 9156): send NS queries one label at a time and report servers that answer them wrongly."`
+	Source            string        `name:"source" help:"Source IP or IP:port for outgoing queries. A port needs --transport udp and --parallelism 1."`
+	Interface         string        `name:"interface" help:"Network interface to send queries from."`
+	MaxTime           time.Duration `default:"2s" help:"Time budget per hop."`
+	MaxHops           int           `default:"32" help:"Maximum delegation hops."`
+	Parallelism       int           `default:"6" help:"Parallelism per hop."`
+	Roots             RootFlags     `embed:""`
+	IPv4              bool          `name:"ipv4" short:"4" xor:"family" help:"Only query nameservers over IPv4."`
+	IPv6              bool          `name:"ipv6" short:"6" xor:"family" help:"Only query nameservers over IPv6."`
+	DualStack         bool          `name:"dual-stack" xor:"family,paths" help:"Trace over IPv4 and IPv6 separately and report hops that only work over one."`
+	CheckDelegation   bool          `name:"check-delegation" help:"Compare each parent's NS set and glue with the child zone's NS and address records."`
+	CheckSOA          bool          `name:"check-soa" help:"Compare SOA serials, MNAME and timers across every nameserver address for the final zone."`
+	CheckLame         bool          `name:"check-lame" help:"Ask every nameserver address of the final zone for its SOA and list which are lame, unreachable or serve the wrong zone."`
+	Fallback          bool          `name:"fallback" help:"When a hop fails, try the zone's other nameservers and address families as a resolver would and record each abandoned server."`
+	CheckDependencies bool          `name:"check-dependencies" help:"Follow the zones that host each zone's nameservers and report dependency cycles and zones that rely on a single provider or TLD."`
+	AllPaths          bool          `name:"all-paths" xor:"paths" help:"Follow every distinct referral from every nameserver and flag servers that disagree with their siblings."`
+	Output            string        `enum:"pretty,json" default:"pretty" help:"Output format."`
+	Verbose           bool          `help:"Enable verbose logging."`
+	Debug             bool          `help:"Enable debug logging (includes raw DNS messages)."`
+}
+
+type HealthCmd struct {
+	Zone        string        `arg:"" name:"zone" help:"Zone to check."`
+	ExpiryDays  int           `name:"expiry-days" default:"7" help:"Flag signatures that expire within this many days."`
+	Transport   string        `enum:"udp,tcp,auto,dot" default:"auto" help:"Transport to use for queries."`
+	TLS         TLSFlags      `embed:"" prefix:"tls-"`
+	Source      string        `name:"source" help:"Source IP or IP:port for the queries along the chain of trust. A port needs --transport udp and --parallelism 1."`
+	Interface   string        `name:"interface" help:"Network interface to send queries from."`
 	MaxTime     time.Duration `default:"2s" help:"Time budget per hop."`
 	MaxHops     int           `default:"32" help:"Maximum delegation hops."`
 	Parallelism int           `default:"6" help:"Parallelism per hop."`
+	Roots       RootFlags     `embed:""`
 	Output      string        `enum:"pretty,json" default:"pretty" help:"Output format."`
 	Verbose     bool          `help:"Enable verbose logging."`
 	Debug       bool          `help:"Enable debug logging (includes raw DNS messages)."`
 }
 
+type RootFlags struct {
+	RootHints   string `name:"root-hints" type:"existingfile" help:"Zone-format root hints file (named.root) to start from."`
+	TrustAnchor string `name:"trust-anchor" type:"existingfile" help:"Root trust anchors from root-anchors.xml or a DS/DNSKEY zone file such as root.key."`
+	Prime       bool   `name:"prime" help:"Send a . NS priming query first, use the returned root servers and warn when the root hints are stale."`
+}
+
+type TLSFlags struct {
+	ServerName string   `name:"server-name" help:"Server name to verify for DoT/DoH/DoQ (defaults to the server address)."`
+	CAFile     string   `name:"ca-file" type:"existingfile" help:"PEM CA bundle used to verify DoT/DoH/DoQ servers."`
+	Pins       []string `name:"pin" help:"Pinned base64 SHA-256 SPKI hash (repeatable). Without --tls-ca-file, pins replace CA verification."`
+}
+
 type VersionCmd struct{}
 
 func main() {
@@ -61,7 +124,7 @@ func main() {
 		return
 	}
 
-	if ctx.Command() == "trace <fqdn> [<rrtype>]" || ctx.Selected().Name == "trace" {
+	if ctx.Selected() != nil && ctx.Selected().Name == "trace" {
 		logger, err := newLogger(cli.Trace.Verbose, cli.Trace.Debug)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -71,6 +134,16 @@ func main() {
 		return
 	}
 
+	if ctx.Selected().Name == "dnssec-health" {
+		logger, err := newLogger(cli.Health.Verbose, cli.Health.Debug)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		runHealth(cli.Health, logger)
+		return
+	}
+
 	logger, err := newLogger(cli.Ladder.Verbose, cli.Ladder.Debug)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -81,13 +154,44 @@ func main() {
 }
 
 func runLadder(cmd LadderCmd, logger *zap.Logger) {
+	tlsConfig, err := dnsclient.BuildTLSConfig(cmd.TLS.ServerName, cmd.TLS.CAFile, cmd.TLS.Pins)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	subnet, err := parseSubnet(cmd.ECS)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	source, err := parseSource(cmd.Source, cmd.Transport, 1)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	compare := []netip.Prefix{}
+	for _, value := range cmd.ECSCompare {
+		prefix, err := parseSubnet(value)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		compare = append(compare, prefix)
+	}
 	mode := dnsclient.Mode(cmd.Transport)
 	client := dnsclient.New(dnsclient.Options{
-		DNSSEC:  cmd.DNSSEC,
-		Mode:    mode,
-		Timeout: cmd.MaxTime,
-		Retries: 1,
-		Logger:  logger,
+		DNSSEC:       cmd.DNSSEC,
+		Mode:         mode,
+		Timeout:      cmd.MaxTime,
+		Retries:      1,
+		ClientSubnet: subnet,
+		NSID:         cmd.NSID,
+		Cookies:      cmd.Cookies,
+		Source:       source,
+		Interface:    cmd.Interface,
+		TLSConfig:    tlsConfig,
+		DoHMethod:    cmd.DoHMethod,
+		Logger:       logger,
 	})
 
 	resolvers := cmd.Resolvers
@@ -100,8 +204,9 @@ func runLadder(cmd LadderCmd, logger *zap.Logger) {
 		resolvers = loaded
 	}
 
-	ctx := context.Background()
-	result, err := ladder.Trace(ctx, client, resolvers, cmd.FQDN, cmd.RRType, ladder.Config{Timeout: cmd.MaxTime, Logger: logger})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	result, err := ladder.Trace(ctx, client, resolvers, cmd.FQDN, cmd.RRType, ladder.Config{Timeout: cmd.MaxTime, Subnets: compare, Logger: logger})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -125,25 +230,81 @@ func runLadder(cmd LadderCmd, logger *zap.Logger) {
 }
 
 func runAuthoritative(cmd TraceCmd, logger *zap.Logger) {
+	tlsConfig, err := dnsclient.BuildTLSConfig(cmd.TLS.ServerName, cmd.TLS.CAFile, cmd.TLS.Pins)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	subnet, err := parseSubnet(cmd.ECS)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	source, err := parseSource(cmd.Source, cmd.Transport, cmd.Parallelism)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	mode := dnsclient.Mode(cmd.Transport)
 	client := dnsclient.New(dnsclient.Options{
-		DNSSEC:  cmd.DNSSEC,
-		Mode:    mode,
-		Timeout: cmd.MaxTime,
-		Retries: 1,
-		Logger:  logger,
+		DNSSEC:       cmd.DNSSEC,
+		Mode:         mode,
+		Timeout:      cmd.MaxTime,
+		Retries:      1,
+		ClientSubnet: subnet,
+		NSID:         cmd.NSID,
+		Cookies:      cmd.Cookies,
+		Source:       source,
+		Interface:    cmd.Interface,
+		TLSConfig:    tlsConfig,
+		Logger:       logger,
 	})
 
+	family := trace.FamilyAny
+	if cmd.IPv4 {
+		family = trace.FamilyIPv4
+	} else if cmd.IPv6 {
+		family = trace.FamilyIPv6
+	}
+
+	hints, anchors, err := loadRoots(cmd.Roots)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	tracer := trace.NewTracer(client, trace.Config{
-		MaxHops:     cmd.MaxHops,
-		MaxTime:     cmd.MaxTime,
-		Parallelism: cmd.Parallelism,
-		Logger:      logger,
-		Verbose:     cmd.Verbose || cmd.Debug,
+		MaxHops:           cmd.MaxHops,
+		MaxTime:           cmd.MaxTime,
+		Parallelism:       cmd.Parallelism,
+		Family:            family,
+		DNSSEC:            cmd.DNSSEC,
+		RootHints:         hints,
+		TrustAnchors:      anchors,
+		Prime:             cmd.Roots.Prime,
+		QNameMin:          cmd.QNameMin,
+		CheckDelegation:   cmd.CheckDelegation,
+		CheckSOA:          cmd.CheckSOA,
+		CheckLame:         cmd.CheckLame,
+		Fallback:          cmd.Fallback,
+		CheckDependencies: cmd.CheckDependencies,
+		Logger:            logger,
+		Verbose:           cmd.Verbose || cmd.Debug,
 	})
 
-	ctx := context.Background()
-	result, err := tracer.Trace(ctx, cmd.FQDN, cmd.RRType)
+	rrtypes := cmd.recordTypes()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var result model.TraceResult
+	switch {
+	case len(rrtypes) > 1:
+		result, err = tracer.TraceTypes(ctx, cmd.FQDN, rrtypes)
+	case cmd.DualStack:
+		result, err = tracer.TraceDualStack(ctx, cmd.FQDN, rrtypes[0])
+	case cmd.AllPaths:
+		result, err = tracer.TraceAllPaths(ctx, cmd.FQDN, rrtypes[0])
+	default:
+		result, err = tracer.Trace(ctx, cmd.FQDN, rrtypes[0])
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -166,6 +327,161 @@ func runAuthoritative(cmd TraceCmd, logger *zap.Logger) {
 	}
 }
 
+// Validate rejects unknown record types and --all-common alongside explicit
+// types while the arguments are parsed.
+func (cmd *TraceCmd) Validate() error {
+	if cmd.AllCommon && len(cmd.RRTypes) > 0 {
+		return fmt.Errorf("--all-common cannot be combined with explicit record types")
+	}
+	rrtypes := cmd.recordTypes()
+	for _, rrtype := range rrtypes {
+		if _, ok := dns.StringToType[rrtype]; !ok {
+			return fmt.Errorf("unsupported rrtype: %s", rrtype)
+		}
+	}
+	if len(rrtypes) > 1 && (cmd.DualStack || cmd.AllPaths) {
+		return fmt.Errorf("--dual-stack and --all-paths trace a single record type")
+	}
+	return nil
+}
+
+// recordTypes returns the types to trace: the positional types split on
+// commas, the --all-common profile, or A when neither is given.
+func (cmd *TraceCmd) recordTypes() []string {
+	if cmd.AllCommon {
+		return commonTypes
+	}
+	rrtypes := []string{}
+	for _, value := range cmd.RRTypes {
+		for _, rrtype := range strings.Split(value, ",") {
+			if rrtype = strings.ToUpper(strings.TrimSpace(rrtype)); rrtype != "" {
+				rrtypes = append(rrtypes, rrtype)
+			}
+		}
+	}
+	if len(rrtypes) == 0 {
+		return []string{"A"}
+	}
+	return rrtypes
+}
+
+func runHealth(cmd HealthCmd, logger *zap.Logger) {
+	tlsConfig, err := dnsclient.BuildTLSConfig(cmd.TLS.ServerName, cmd.TLS.CAFile, cmd.TLS.Pins)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	source, err := parseSource(cmd.Source, cmd.Transport, cmd.Parallelism)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	client := dnsclient.New(dnsclient.Options{
+		DNSSEC:    true,
+		Mode:      dnsclient.Mode(cmd.Transport),
+		Timeout:   cmd.MaxTime,
+		Retries:   1,
+		Source:    source,
+		Interface: cmd.Interface,
+		TLSConfig: tlsConfig,
+		Logger:    logger,
+	})
+
+	hints, anchors, err := loadRoots(cmd.Roots)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	tracer := trace.NewTracer(client, trace.Config{
+		MaxHops:      cmd.MaxHops,
+		MaxTime:      cmd.MaxTime,
+		Parallelism:  cmd.Parallelism,
+		DNSSEC:       true,
+		RootHints:    hints,
+		TrustAnchors: anchors,
+		Prime:        cmd.Roots.Prime,
+		Logger:       logger,
+		Verbose:      cmd.Verbose || cmd.Debug,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := tracer.Health(ctx, cmd.Zone, time.Duration(cmd.ExpiryDays)*24*time.Hour)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var rendered string
+	if cmd.Output == "json" {
+		rendered, err = output.RenderJSON(report)
+	} else {
+		rendered = output.RenderHealthPretty(report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Println(rendered)
+	if report.Diagnosis.Classification != "SUCCESS" {
+		os.Exit(2)
+	}
+}
+
+func loadRoots(flags RootFlags) (trace.RootHints, []*dns.DS, error) {
+	var hints trace.RootHints
+	var anchors []*dns.DS
+	var err error
+	if flags.RootHints != "" {
+		hints, err = trace.LoadRootHints(flags.RootHints)
+		if err != nil {
+			return trace.RootHints{}, nil, err
+		}
+	}
+	if flags.TrustAnchor != "" {
+		anchors, err = trace.LoadTrustAnchors(flags.TrustAnchor)
+		if err != nil {
+			return trace.RootHints{}, nil, err
+		}
+	}
+	return hints, anchors, nil
+}
+
+func parseSubnet(value string) (netip.Prefix, error) {
+	if value == "" {
+		return netip.Prefix{}, nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid client subnet %q: %w", value, err)
+	}
+	return prefix.Masked(), nil
+}
+
+// parseSource parses --source. A fixed port is only allowed over UDP or DoQ
+// and when queries run one at a time, since TCP connections and concurrent
+// sockets cannot share it.
+func parseSource(value string, transport string, parallelism int) (netip.AddrPort, error) {
+	if value == "" {
+		return netip.AddrPort{}, nil
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.AddrPortFrom(addr, 0), nil
+	}
+	addrPort, err := netip.ParseAddrPort(value)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid source address %q: expected IP or IP:port", value)
+	}
+	if addrPort.Port() != 0 && transport != "udp" && transport != "doq" {
+		return netip.AddrPort{}, fmt.Errorf("--source %s sets a port, which needs --transport udp: TCP, DoT and DoH connections cannot use a fixed source port", value)
+	}
+	if addrPort.Port() != 0 && parallelism != 1 {
+		return netip.AddrPort{}, fmt.Errorf("--source %s sets a port, which needs --parallelism 1: concurrent queries cannot share one source port", value)
+	}
+	return addrPort, nil
+}
+
 func newLogger(verbose bool, debug bool) (*zap.Logger, error) {
 	if debug {
 		cfg := zap.NewDevelopmentConfig()
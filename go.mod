@@ -6,7 +6,9 @@ require (
 	github.com/alecthomas/kong v0.9.0
 	github.com/charmbracelet/lipgloss v0.11.0
 	github.com/miekg/dns v1.1.57
+	github.com/quic-go/quic-go v0.59.1
 	go.uber.org/zap v1.27.0
+	golang.org/x/net v0.43.0
 )
 
 require (
@@ -18,8 +20,9 @@ require (
 	github.com/muesli/termenv v0.15.2 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
-	golang.org/x/mod v0.12.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sys v0.19.0 // indirect
-	golang.org/x/tools v0.13.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 )
@@ -1,23 +1,45 @@
 package analyze
 
-import "github.com/jaxxstorm/dnstrace/internal/model"
+import (
+	"sort"
+
+	"github.com/jaxxstorm/dnstrace/internal/model"
+)
 
 type OutcomeKind string
 
 const (
-	OutcomeSuccess          OutcomeKind = "SUCCESS"
-	OutcomeNXDOMAIN         OutcomeKind = "NXDOMAIN"
-	OutcomeNODATA           OutcomeKind = "NODATA"
-	OutcomeBrokenDelegation OutcomeKind = "BROKEN_DELEGATION"
-	OutcomeLameDelegation   OutcomeKind = "LAME_DELEGATION"
-	OutcomeServfailTimeout  OutcomeKind = "SERVFAIL_TIMEOUT"
+	OutcomeSuccess             OutcomeKind = "SUCCESS"
+	OutcomeNXDOMAIN            OutcomeKind = "NXDOMAIN"
+	OutcomeNODATA              OutcomeKind = "NODATA"
+	OutcomeBrokenDelegation    OutcomeKind = "BROKEN_DELEGATION"
+	OutcomeLameDelegation      OutcomeKind = "LAME_DELEGATION"
+	OutcomeServfailTimeout     OutcomeKind = "SERVFAIL_TIMEOUT"
+	OutcomeAddressFamily       OutcomeKind = "ADDRESS_FAMILY_MISMATCH"
+	OutcomeDNSSECBogus         OutcomeKind = "DNSSEC_BOGUS"
+	OutcomeDNSSECInsecure      OutcomeKind = "DNSSEC_INSECURE"
+	OutcomeDNSSECIndeterminate OutcomeKind = "DNSSEC_INDETERMINATE"
+	OutcomeDNSSECBadDenial     OutcomeKind = "DNSSEC_BAD_DENIAL"
+	OutcomeDNSSECExpiring      OutcomeKind = "DNSSEC_EXPIRING"
+	OutcomeQNameMinimisation   OutcomeKind = "QNAME_MINIMISATION_FAILURE"
+	OutcomeInconsistentServers OutcomeKind = "INCONSISTENT_NAMESERVERS"
+	OutcomeNSMismatch          OutcomeKind = "NS_MISMATCH"
+	OutcomeGlueMismatch        OutcomeKind = "GLUE_MISMATCH"
+	OutcomeStaleSecondary      OutcomeKind = "STALE_SECONDARY"
+	OutcomeSOAMismatch         OutcomeKind = "SOA_MISMATCH"
+	OutcomeFragileDependencies OutcomeKind = "FRAGILE_NS_DEPENDENCIES"
 )
 
 type Outcome struct {
 	Kind         OutcomeKind
 	Summary      string
 	EvidenceStep int
-	Hints        []string
+	// EvidenceSteps lists further steps that support the outcome, such as the
+	// DS and DNSKEY queries behind a DNSSEC failure.
+	EvidenceSteps []int
+	// Records holds the DNS records at fault, when there are specific ones.
+	Records []string
+	Hints   []string
 }
 
 func Diagnose(outcome Outcome) model.Diagnosis {
@@ -25,10 +47,26 @@ func Diagnose(outcome Outcome) model.Diagnosis {
 	if outcome.EvidenceStep >= 0 {
 		steps = append(steps, outcome.EvidenceStep)
 	}
+	for _, step := range outcome.EvidenceSteps {
+		if step >= 0 && !containsStep(steps, step) {
+			steps = append(steps, step)
+		}
+	}
+	sort.Ints(steps)
 	return model.Diagnosis{
 		Classification: string(outcome.Kind),
 		Summary:        outcome.Summary,
 		EvidenceSteps:  steps,
+		Records:        outcome.Records,
 		Hints:          outcome.Hints,
 	}
 }
+
+func containsStep(steps []int, step int) bool {
+	for _, s := range steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
@@ -18,3 +18,10 @@ func TestDiagnoseNoEvidence(t *testing.T) {
 		t.Fatalf("expected no evidence steps")
 	}
 }
+
+func TestDiagnoseMergesEvidenceSteps(t *testing.T) {
+	d := Diagnose(Outcome{Kind: OutcomeDNSSECBogus, Summary: "bogus", EvidenceStep: 5, EvidenceSteps: []int{3, 5, -1}})
+	if len(d.EvidenceSteps) != 2 || d.EvidenceSteps[0] != 3 || d.EvidenceSteps[1] != 5 {
+		t.Fatalf("expected evidence steps [3 5], got %v", d.EvidenceSteps)
+	}
+}
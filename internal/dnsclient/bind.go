@@ -0,0 +1,52 @@
+package dnsclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// errSourcePort is returned for queries over TCP, DoT or DoH when the source
+// sets a port, which only UDP and DoQ sockets can use.
+var errSourcePort = errors.New("a fixed source port applies to UDP and DoQ only")
+
+// binding pins outgoing queries to a source address and/or interface so they
+// follow a chosen uplink or VRF instead of the default route.
+type binding struct {
+	source netip.AddrPort
+	iface  string
+}
+
+// dialer binds the source address. Only UDP sockets take the source port:
+// TCP connections are pooled and held open to several servers at once, so a
+// fixed port would collide with EADDRINUSE. Client.exchange refuses stream
+// queries with a source port before they get here.
+func (b binding) dialer(network string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if b.source.Addr().IsValid() {
+		ip := net.IP(b.source.Addr().AsSlice())
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip, Port: int(b.source.Port())}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if b.iface != "" {
+		d.Control = bindToInterface(b.iface)
+	}
+	return d
+}
+
+func (b binding) listenPacket(ctx context.Context) (net.PacketConn, error) {
+	cfg := net.ListenConfig{}
+	if b.iface != "" {
+		cfg.Control = bindToInterface(b.iface)
+	}
+	address := ":0"
+	if b.source.Addr().IsValid() {
+		address = b.source.String()
+	}
+	return cfg.ListenPacket(ctx, "udp", address)
+}
@@ -0,0 +1,16 @@
+package dnsclient
+
+import "syscall"
+
+func bindToInterface(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
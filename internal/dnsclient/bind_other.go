@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package dnsclient
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+func bindToInterface(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("binding to interface %s is not supported on %s; use a source address instead", iface, runtime.GOOS)
+	}
+}
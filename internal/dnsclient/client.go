@@ -2,9 +2,11 @@ package dnsclient
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -18,25 +20,45 @@ const (
 	ModeUDP  Mode = "udp"
 	ModeTCP  Mode = "tcp"
 	ModeAuto Mode = "auto"
+	ModeDoT  Mode = "dot"
+	ModeDoH  Mode = "doh"
+	ModeDoQ  Mode = "doq"
 )
 
 type Options struct {
-	DNSSEC    bool
-	Mode      Mode
-	Timeout   time.Duration
-	Retries   int
-	EDNS0Size uint16
-	Logger    *zap.Logger
+	DNSSEC       bool
+	Mode         Mode
+	Timeout      time.Duration
+	Retries      int
+	EDNS0Size    uint16
+	ClientSubnet netip.Prefix
+	NSID         bool
+	Cookies      bool
+	Source       netip.AddrPort
+	Interface    string
+	TLSConfig    *tls.Config
+	DoHMethod    string
+	Logger       *zap.Logger
 }
 
 type Client struct {
 	opts Options
 	udp  Transport
 	tcp  Transport
+	dot  Transport
+	doh  Transport
+	doq  Transport
+
+	cookies *cookieJar
 }
 
 func New(opts Options) *Client {
-	return NewWithTransports(opts, &udpTransport{timeout: opts.Timeout}, &tcpTransport{timeout: opts.Timeout})
+	bind := binding{source: opts.Source, iface: opts.Interface}
+	client := NewWithTransports(opts, &udpTransport{timeout: opts.Timeout, bind: bind}, newPooledTCPTransport(opts.Timeout, bind))
+	client.dot = &dotTransport{timeout: opts.Timeout, tlsConfig: opts.TLSConfig, bind: bind}
+	client.doh = newDoHTransport(opts.Timeout, opts.DoHMethod, opts.TLSConfig, bind)
+	client.doq = &doqTransport{timeout: opts.Timeout, tlsConfig: opts.TLSConfig, bind: bind}
+	return client
 }
 
 func NewWithTransports(opts Options, udp Transport, tcp Transport) *Client {
@@ -52,14 +74,32 @@ func NewWithTransports(opts Options, udp Transport, tcp Transport) *Client {
 	if opts.Mode == "" {
 		opts.Mode = ModeAuto
 	}
+	if opts.DoHMethod == "" {
+		opts.DoHMethod = "POST"
+	}
 	if opts.Logger == nil {
 		opts.Logger = zap.NewNop()
 	}
-	return &Client{
+	client := &Client{
 		opts: opts,
 		udp:  udp,
 		tcp:  tcp,
 	}
+	if opts.Cookies {
+		client.cookies = newCookieJar()
+	}
+	return client
+}
+
+// Close releases connections held open by the client's transports.
+func (c *Client) Close() error {
+	var errs []error
+	for _, transport := range []Transport{c.udp, c.tcp, c.dot, c.doh, c.doq} {
+		if err := closeTransport(transport); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (c *Client) BuildQuery(name string, qtype uint16) *dns.Msg {
@@ -67,48 +107,121 @@ func (c *Client) BuildQuery(name string, qtype uint16) *dns.Msg {
 	msg.SetQuestion(dns.Fqdn(name), qtype)
 	msg.RecursionDesired = false
 	msg.SetEdns0(c.opts.EDNS0Size, c.opts.DNSSEC)
+	SetClientSubnet(msg, c.opts.ClientSubnet)
+	if c.opts.NSID {
+		RequestNSID(msg)
+	}
 	return msg
 }
 
 func (c *Client) Exchange(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, string, error) {
-	server = NormalizeServer(server)
+	resp, rtt, _, transport, err := c.ExchangeWithHandshake(ctx, server, msg)
+	return resp, rtt, transport, err
+}
+
+// ExchangeWithHandshake is Exchange with the session setup time reported
+// separately. Only transports that dial per query (DoQ) report a handshake.
+//
+// With cookies enabled the COOKIE option is added to msg itself, so callers
+// can pass msg to CookieStatus afterwards.
+func (c *Client) ExchangeWithHandshake(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, time.Duration, string, error) {
+	server = c.NormalizeServer(server)
+	if c.cookies == nil {
+		return c.exchange(ctx, server, msg)
+	}
+	c.cookies.attach(msg, server)
+	resp, rtt, handshake, transport, err := c.exchange(ctx, server, msg)
+	if err != nil || resp == nil {
+		return resp, rtt, handshake, transport, err
+	}
+	if c.cookies.learn(server, msg, resp) && resp.Rcode == dns.RcodeBadCookie {
+		c.opts.Logger.Debug("badcookie, retrying with server cookie", zap.String("server", server))
+		c.cookies.attach(msg, server)
+		return c.exchange(ctx, server, msg)
+	}
+	return resp, rtt, handshake, transport, err
+}
+
+func (c *Client) exchange(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, time.Duration, string, error) {
+	// Stream transports cannot share one source port, so they refuse it
+	// rather than dropping it.
+	fixedPort := c.opts.Source.Port() != 0
+	if isDoHURL(server) {
+		if c.doh == nil {
+			return nil, 0, 0, "doh", errors.New("doh transport not configured")
+		}
+		if fixedPort {
+			return nil, 0, 0, "doh", errSourcePort
+		}
+		resp, rtt, handshake, err := c.exchangeWithRetries(ctx, c.doh, server, msg, "doh")
+		return resp, rtt, handshake, "doh", err
+	}
+	if isDoQURL(server) {
+		if c.doq == nil {
+			return nil, 0, 0, "doq", errors.New("doq transport not configured")
+		}
+		resp, rtt, handshake, err := c.exchangeWithRetries(ctx, c.doq, strings.TrimPrefix(server, "quic://"), msg, "doq")
+		return resp, rtt, handshake, "doq", err
+	}
 	switch c.opts.Mode {
+	case ModeDoT:
+		if c.dot == nil {
+			return nil, 0, 0, "dot", errors.New("dot transport not configured")
+		}
+		if fixedPort {
+			return nil, 0, 0, "dot", errSourcePort
+		}
+		resp, rtt, handshake, err := c.exchangeWithRetries(ctx, c.dot, dotAddress(server), msg, "dot")
+		return resp, rtt, handshake, "dot", err
 	case ModeTCP:
-		resp, rtt, err := c.exchangeWithRetries(ctx, c.tcp, server, msg, "tcp")
-		return resp, rtt, "tcp", err
+		if fixedPort {
+			return nil, 0, 0, "tcp", errSourcePort
+		}
+		resp, rtt, handshake, err := c.exchangeWithRetries(ctx, c.tcp, server, msg, "tcp")
+		return resp, rtt, handshake, "tcp", err
 	case ModeUDP:
-		resp, rtt, err := c.exchangeWithRetries(ctx, c.udp, server, msg, "udp")
-		return resp, rtt, "udp", err
+		resp, rtt, handshake, err := c.exchangeWithRetries(ctx, c.udp, server, msg, "udp")
+		return resp, rtt, handshake, "udp", err
 	case ModeAuto:
-		resp, rtt, err := c.exchangeWithRetries(ctx, c.udp, server, msg, "udp")
+		resp, rtt, handshake, err := c.exchangeWithRetries(ctx, c.udp, server, msg, "udp")
 		if err == nil && resp != nil && resp.Truncated {
 			c.opts.Logger.Debug("udp truncated, retrying with tcp", zap.String("server", server))
-			resp, rtt, err = c.exchangeWithRetries(ctx, c.tcp, server, msg, "tcp")
-			return resp, rtt, "tcp", err
+			if fixedPort {
+				return nil, 0, 0, "tcp", errSourcePort
+			}
+			resp, rtt, handshake, err = c.exchangeWithRetries(ctx, c.tcp, server, msg, "tcp")
+			return resp, rtt, handshake, "tcp", err
 		}
-		return resp, rtt, "udp", err
+		return resp, rtt, handshake, "udp", err
 	default:
-		return nil, 0, "", fmt.Errorf("unsupported transport mode: %s", c.opts.Mode)
+		return nil, 0, 0, "", fmt.Errorf("unsupported transport mode: %s", c.opts.Mode)
 	}
 }
 
-func (c *Client) exchangeWithRetries(ctx context.Context, transport Transport, server string, msg *dns.Msg, mode string) (*dns.Msg, time.Duration, error) {
+func (c *Client) exchangeWithRetries(ctx context.Context, transport Transport, server string, msg *dns.Msg, mode string) (*dns.Msg, time.Duration, time.Duration, error) {
 	var lastErr error
 	for i := 0; i < c.opts.Retries; i++ {
 		if err := ctx.Err(); err != nil {
-			return nil, 0, err
+			return nil, 0, 0, err
+		}
+		var resp *dns.Msg
+		var rtt, handshake time.Duration
+		var err error
+		if ht, ok := transport.(handshakeTransport); ok {
+			resp, rtt, handshake, err = ht.ExchangeWithHandshake(ctx, server, msg.Copy())
+		} else {
+			resp, rtt, err = transport.Exchange(ctx, server, msg.Copy())
 		}
-		resp, rtt, err := transport.Exchange(ctx, server, msg.Copy())
 		if err == nil {
 			c.logRaw(mode, server, msg, resp)
-			return resp, rtt, nil
+			return resp, rtt, handshake, nil
 		}
 		lastErr = err
 	}
 	if lastErr == nil {
 		lastErr = errors.New("dns exchange failed")
 	}
-	return nil, 0, lastErr
+	return nil, 0, 0, lastErr
 }
 
 func (c *Client) logRaw(mode, server string, req, resp *dns.Msg) {
@@ -128,7 +241,29 @@ func (c *Client) logRaw(mode, server string, req, resp *dns.Msg) {
 	}
 }
 
+// NormalizeServer adds the default port for the client's transport mode, or
+// the URL form used for DoH and DoQ. DoH URLs pass through as-is.
+func (c *Client) NormalizeServer(server string) string {
+	if isDoHURL(server) {
+		return server
+	}
+	if isDoQURL(server) || c.opts.Mode == ModeDoQ {
+		return doqURL(server)
+	}
+	if c.opts.Mode == ModeDoH {
+		return dohURL(server)
+	}
+	if c.opts.Mode == ModeDoT {
+		return normalizeServer(server, "853")
+	}
+	return normalizeServer(server, "53")
+}
+
 func NormalizeServer(server string) string {
+	return normalizeServer(server, "53")
+}
+
+func normalizeServer(server string, port string) string {
 	if server == "" {
 		return server
 	}
@@ -136,13 +271,23 @@ func NormalizeServer(server string) string {
 		if strings.Contains(server, "]:") {
 			return server
 		}
-		return server + ":53"
+		return server + ":" + port
 	}
 	if _, _, err := net.SplitHostPort(server); err == nil {
 		return server
 	}
 	if strings.Contains(server, ":") {
-		return "[" + server + "]:53"
+		return "[" + server + "]:" + port
+	}
+	return server + ":" + port
+}
+
+// dotAddress moves classic port 53 addresses, such as glue built by the
+// delegation trace, to the DoT port.
+func dotAddress(server string) string {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || port != "53" {
+		return server
 	}
-	return server + ":53"
+	return net.JoinHostPort(host, "853")
 }
@@ -2,11 +2,30 @@ package dnsclient
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 )
 
 func TestAutoFallbackToTCPOnTruncation(t *testing.T) {
@@ -61,3 +80,652 @@ func TestAutoFallbackToTCPOnTruncation(t *testing.T) {
 		t.Fatalf("expected answer after tcp fallback")
 	}
 }
+
+func TestDoTExchangeWithCABundle(t *testing.T) {
+	cert, leaf := newTestCertificate(t)
+	addr := startDoTServer(t, cert)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	tlsConfig, err := BuildTLSConfig("dns.test", caFile, nil)
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+
+	client := New(Options{Mode: ModeDoT, Timeout: time.Second, TLSConfig: tlsConfig})
+	resp, _, transport, err := client.Exchange(context.Background(), addr, client.BuildQuery("example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if transport != "dot" {
+		t.Fatalf("expected dot transport, got %s", transport)
+	}
+	if resp == nil || len(resp.Answer) == 0 {
+		t.Fatalf("expected answer over dot")
+	}
+
+	wrongName, err := BuildTLSConfig("other.test", caFile, nil)
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+	client = New(Options{Mode: ModeDoT, Timeout: time.Second, TLSConfig: wrongName})
+	if _, _, _, err := client.Exchange(context.Background(), addr, client.BuildQuery("example.com.", dns.TypeA)); err == nil {
+		t.Fatalf("expected hostname verification failure")
+	}
+}
+
+func TestDoTExchangeWithSPKIPin(t *testing.T) {
+	cert, leaf := newTestCertificate(t)
+	addr := startDoTServer(t, cert)
+
+	tlsConfig, err := BuildTLSConfig("", "", []string{SPKIPin(leaf)})
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+	client := New(Options{Mode: ModeDoT, Timeout: time.Second, TLSConfig: tlsConfig})
+	if _, _, _, err := client.Exchange(context.Background(), addr, client.BuildQuery("example.com.", dns.TypeA)); err != nil {
+		t.Fatalf("exchange with matching pin failed: %v", err)
+	}
+
+	_, other := newTestCertificate(t)
+	tlsConfig, err = BuildTLSConfig("", "", []string{SPKIPin(other)})
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+	client = New(Options{Mode: ModeDoT, Timeout: time.Second, TLSConfig: tlsConfig})
+	if _, _, _, err := client.Exchange(context.Background(), addr, client.BuildQuery("example.com.", dns.TypeA)); err == nil {
+		t.Fatalf("expected pin mismatch failure")
+	}
+}
+
+func TestNormalizeServerUsesDoTPort(t *testing.T) {
+	client := New(Options{Mode: ModeDoT})
+	if got := client.NormalizeServer("192.0.2.1"); got != "192.0.2.1:853" {
+		t.Fatalf("expected port 853, got %s", got)
+	}
+	if got := client.NormalizeServer("2001:db8::1"); got != "[2001:db8::1]:853" {
+		t.Fatalf("expected bracketed port 853, got %s", got)
+	}
+	if got := dotAddress("192.0.2.1:53"); got != "192.0.2.1:853" {
+		t.Fatalf("expected glue address moved to 853, got %s", got)
+	}
+}
+
+func startDoTServer(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.10"),
+		})
+		_ = w.WriteMsg(m)
+	})
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("tls listen: %v", err)
+	}
+	srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: mux}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return ln.Addr().String()
+}
+
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func TestDoHExchangeGetAndPost(t *testing.T) {
+	seen := map[string]bool{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var packed []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			packed, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(packed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		seen[r.Method+" "+r.Proto] = true
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.10"),
+		})
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(out)
+	})
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	for _, method := range []string{"GET", "POST"} {
+		client := New(Options{Mode: ModeAuto, Timeout: time.Second, DoHMethod: method, TLSConfig: &tls.Config{RootCAs: pool}})
+		msg := client.BuildQuery("example.com.", dns.TypeA)
+		resp, _, transport, err := client.Exchange(context.Background(), srv.URL+"/dns-query{?dns}", msg)
+		if err != nil {
+			t.Fatalf("%s exchange failed: %v", method, err)
+		}
+		if transport != "doh" {
+			t.Fatalf("expected doh transport, got %s", transport)
+		}
+		if resp.Id != msg.Id || len(resp.Answer) == 0 {
+			t.Fatalf("%s: expected answer with original id", method)
+		}
+		if !seen[method+" HTTP/2.0"] {
+			t.Fatalf("%s: expected HTTP/2 request, saw %v", method, seen)
+		}
+	}
+}
+
+func TestDoHTemplateExpansion(t *testing.T) {
+	if got := expandDoHTemplate("https://dns.example/dns-query{?dns}", "AAAB"); got != "https://dns.example/dns-query?dns=AAAB" {
+		t.Fatalf("unexpected GET url: %s", got)
+	}
+	if got := expandDoHTemplate("https://dns.example/q?ct=1", "AAAB"); got != "https://dns.example/q?ct=1&dns=AAAB" {
+		t.Fatalf("unexpected GET url with query: %s", got)
+	}
+	if got := expandDoHTemplate("https://dns.example/dns-query{?dns}", ""); got != "https://dns.example/dns-query" {
+		t.Fatalf("unexpected POST url: %s", got)
+	}
+	client := New(Options{Mode: ModeDoH})
+	if got := client.NormalizeServer("1.1.1.1"); got != "https://1.1.1.1/dns-query{?dns}" {
+		t.Fatalf("unexpected doh url: %s", got)
+	}
+}
+
+func TestDoQExchangeReportsHandshake(t *testing.T) {
+	cert, leaf := newTestCertificate(t)
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{doqALPN}}, nil)
+	if err != nil {
+		t.Fatalf("quic listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				var length [2]byte
+				if _, err := io.ReadFull(stream, length[:]); err != nil {
+					return
+				}
+				packed := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(stream, packed); err != nil {
+					return
+				}
+				req := new(dns.Msg)
+				if err := req.Unpack(packed); err != nil || req.Id != 0 {
+					stream.CancelWrite(1)
+					return
+				}
+				m := new(dns.Msg)
+				m.SetReply(req)
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("192.0.2.10"),
+				})
+				out, _ := m.Pack()
+				frame := append([]byte{byte(len(out) >> 8), byte(len(out))}, out...)
+				_, _ = stream.Write(frame)
+				_ = stream.Close()
+			}()
+		}
+	}()
+
+	tlsConfig, err := BuildTLSConfig("", "", []string{SPKIPin(leaf)})
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+	client := New(Options{Mode: ModeAuto, Timeout: 2 * time.Second, TLSConfig: tlsConfig})
+	msg := client.BuildQuery("example.com.", dns.TypeA)
+	resp, _, handshake, transport, err := client.ExchangeWithHandshake(context.Background(), "quic://"+ln.Addr().String(), msg)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if transport != "doq" {
+		t.Fatalf("expected doq transport, got %s", transport)
+	}
+	if handshake <= 0 {
+		t.Fatalf("expected handshake duration to be reported")
+	}
+	if resp.Id != msg.Id || len(resp.Answer) == 0 {
+		t.Fatalf("expected answer with original id")
+	}
+}
+
+func TestExchangeReturnsOnCancel(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("udp listen: %v", err)
+	}
+	defer udpConn.Close()
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("tcp listen: %v", err)
+	}
+	defer tcpLn.Close()
+
+	for _, tc := range []struct {
+		mode Mode
+		addr string
+	}{
+		{ModeUDP, udpConn.LocalAddr().String()},
+		{ModeTCP, tcpLn.Addr().String()},
+	} {
+		client := New(Options{Mode: tc.mode, Timeout: 10 * time.Second})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		_, _, _, err := client.Exchange(ctx, tc.addr, client.BuildQuery("example.com.", dns.TypeA))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: expected context.Canceled, got %v", tc.mode, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("%s: exchange ignored cancellation for %s", tc.mode, elapsed)
+		}
+	}
+}
+
+func TestTCPReusesConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("tcp listen: %v", err)
+	}
+	counting := &countingListener{Listener: ln}
+	srv := &dns.Server{Listener: counting, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	client := New(Options{Mode: ModeTCP, Timeout: time.Second})
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if _, _, _, err := client.Exchange(context.Background(), ln.Addr().String(), client.BuildQuery("example.com.", dns.TypeA)); err != nil {
+			t.Fatalf("exchange %d failed: %v", i, err)
+		}
+	}
+	if got := counting.accepted.Load(); got != 1 {
+		t.Fatalf("expected 1 tcp connection, got %d", got)
+	}
+}
+
+func TestTCPWriteFailureIsRetryable(t *testing.T) {
+	local, remote := net.Pipe()
+	remote.Close()
+	pc := &pipelinedConn{ready: make(chan struct{}), pending: map[uint16]pendingQuery{}, idleTimeout: time.Second, conn: &dns.Conn{Conn: local}}
+	pc.idle = time.AfterFunc(time.Hour, func() {})
+	close(pc.ready)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	_, _, err := pc.exchange(context.Background(), msg)
+	if !errors.Is(err, errConnClosed) {
+		t.Fatalf("expected a write failure to match errConnClosed, got %v", err)
+	}
+}
+
+func TestTCPDropsResponsesForOtherQuestions(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	pc := &pipelinedConn{ready: make(chan struct{}), pending: map[uint16]pendingQuery{}, idleTimeout: time.Second, conn: &dns.Conn{Conn: local}}
+	pc.idle = time.AfterFunc(time.Hour, func() {})
+	close(pc.ready)
+	go pc.readLoop()
+	go func() {
+		server := &dns.Conn{Conn: remote}
+		query, err := server.ReadMsg()
+		if err != nil {
+			return
+		}
+		stray := new(dns.Msg)
+		stray.SetQuestion("other.example.", dns.TypeA)
+		stray.Id = query.Id
+		stray.Response = true
+		_ = server.WriteMsg(stray)
+		reply := new(dns.Msg)
+		reply.SetReply(query)
+		reply.Question[0].Name = "EXAMPLE.com."
+		_ = server.WriteMsg(reply)
+	}()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, _, err := pc.exchange(ctx, msg)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if resp.Question[0].Name != "EXAMPLE.com." {
+		t.Fatalf("expected the response for the query's question, got %s", resp.Question[0].Name)
+	}
+}
+
+func TestTCPDialOutlivesCancelledCaller(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("tcp listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	transport := newPooledTCPTransport(time.Second, binding{})
+	defer transport.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := transport.conn(ctx, ln.Addr().String()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	transport.mu.Lock()
+	pc := transport.conns[ln.Addr().String()]
+	transport.mu.Unlock()
+	if pc == nil {
+		t.Fatalf("expected the dial to stay pooled")
+	}
+	<-pc.ready
+	if pc.err != nil {
+		t.Fatalf("expected the dial to succeed for other callers, got %v", pc.err)
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestTCPPipelinesOutOfOrderResponses(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("tcp listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan int, 4)
+	go func() {
+		count := 0
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			count++
+			accepted <- count
+			go func() {
+				defer conn.Close()
+				dc := &dns.Conn{Conn: conn}
+				queries := []*dns.Msg{}
+				for len(queries) < 2 {
+					q, err := dc.ReadMsg()
+					if err != nil {
+						return
+					}
+					queries = append(queries, q)
+				}
+				for i := len(queries) - 1; i >= 0; i-- {
+					m := new(dns.Msg)
+					m.SetReply(queries[i])
+					m.Answer = append(m.Answer, &dns.TXT{
+						Hdr: dns.RR_Header{Name: queries[i].Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+						Txt: []string{queries[i].Question[0].Name},
+					})
+					_ = dc.WriteMsg(m)
+				}
+			}()
+		}
+	}()
+
+	client := New(Options{Mode: ModeTCP, Timeout: 2 * time.Second})
+	defer client.Close()
+
+	names := []string{"one.example.", "two.example."}
+	errs := make(chan error, len(names))
+	for _, name := range names {
+		go func(name string) {
+			resp, _, _, err := client.Exchange(context.Background(), ln.Addr().String(), client.BuildQuery(name, dns.TypeTXT))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if len(resp.Answer) == 0 || resp.Answer[0].Header().Name != name {
+				errs <- errors.New("response matched to the wrong query")
+				return
+			}
+			errs <- nil
+		}(name)
+	}
+	for range names {
+		if err := <-errs; err != nil {
+			t.Fatalf("pipelined exchange failed: %v", err)
+		}
+	}
+	if len(accepted) != 1 {
+		t.Fatalf("expected one pipelined connection, got %d", len(accepted))
+	}
+}
+
+func TestBuildQueryAttachesClientSubnet(t *testing.T) {
+	client := New(Options{ClientSubnet: netip.MustParsePrefix("203.0.113.77/24")})
+	msg := client.BuildQuery("example.com.", dns.TypeA)
+	subnet, scope, ok := ClientSubnetScope(msg)
+	if !ok {
+		t.Fatalf("expected client subnet option")
+	}
+	if subnet != "203.0.113.0/24" || scope != 0 {
+		t.Fatalf("unexpected subnet %s scope %d", subnet, scope)
+	}
+
+	SetClientSubnet(msg, netip.MustParsePrefix("2001:db8::/56"))
+	subnet, _, _ = ClientSubnetScope(msg)
+	if subnet != "2001:db8::/56" {
+		t.Fatalf("expected subnet to be replaced, got %s", subnet)
+	}
+	if n := len(msg.IsEdns0().Option); n != 1 {
+		t.Fatalf("expected a single edns option, got %d", n)
+	}
+}
+
+func TestCookiesAreRememberedPerServer(t *testing.T) {
+	const serverCookie = "0102030405060708"
+	var lastSent string
+	transport := &MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		lastSent = cookieValue(msg)
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		resp.SetEdns0(1232, false)
+		resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: lastSent[:16] + serverCookie}}
+		return resp, time.Millisecond, nil
+	}}
+	client := NewWithTransports(Options{Mode: ModeUDP, Cookies: true}, transport, transport)
+
+	first := client.BuildQuery("example.com.", dns.TypeA)
+	resp, _, _, err := client.Exchange(context.Background(), "192.0.2.1", first)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if len(lastSent) != 16 {
+		t.Fatalf("expected client-only cookie on first query, got %q", lastSent)
+	}
+	if status := CookieStatus(first, resp); status != CookieSupported {
+		t.Fatalf("expected supported, got %s", status)
+	}
+
+	second := client.BuildQuery("example.com.", dns.TypeA)
+	if _, _, _, err := client.Exchange(context.Background(), "192.0.2.1", second); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if lastSent[16:] != serverCookie {
+		t.Fatalf("expected server cookie to be echoed back, got %q", lastSent)
+	}
+
+	other := client.BuildQuery("example.com.", dns.TypeA)
+	if _, _, _, err := client.Exchange(context.Background(), "192.0.2.2", other); err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if len(lastSent) != 16 {
+		t.Fatalf("expected no server cookie for a new server, got %q", lastSent)
+	}
+}
+
+func TestCookieStatus(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	req.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "aaaaaaaaaaaaaaaa"}}
+
+	reply := func(cookie string) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		if cookie != "" {
+			resp.SetEdns0(1232, false)
+			resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie}}
+		}
+		return resp
+	}
+
+	cases := map[string]string{
+		"":                                 CookieIgnored,
+		"aaaaaaaaaaaaaaaa0102030405060708": CookieSupported,
+		"bbbbbbbbbbbbbbbb0102030405060708": CookieMismatch,
+		"aaaaaaaaaaaaaaaa":                 CookieMalformed,
+	}
+	for cookie, want := range cases {
+		if got := CookieStatus(req, reply(cookie)); got != want {
+			t.Fatalf("cookie %q: expected %s, got %s", cookie, want, got)
+		}
+	}
+}
+
+func TestSourceAddressBinding(t *testing.T) {
+	remotes := make(chan string, 2)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		remotes <- host
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("udp listen: %v", err)
+	}
+	addr := udpConn.LocalAddr().String()
+	tcpLn, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("tcp listen: %v", err)
+	}
+	udpSrv := &dns.Server{PacketConn: udpConn, Handler: handler}
+	tcpSrv := &dns.Server{Listener: tcpLn, Handler: handler}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+	defer udpSrv.Shutdown()
+	defer tcpSrv.Shutdown()
+
+	source := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), 0)
+	for _, mode := range []Mode{ModeUDP, ModeTCP} {
+		client := New(Options{Mode: mode, Timeout: time.Second, Source: source})
+		if _, _, _, err := client.Exchange(context.Background(), addr, client.BuildQuery("example.com.", dns.TypeA)); err != nil {
+			t.Skipf("%s: loopback alias unavailable: %v", mode, err)
+		}
+		client.Close()
+		if got := <-remotes; got != "127.0.0.2" {
+			t.Fatalf("%s: expected query from 127.0.0.2, got %s", mode, got)
+		}
+	}
+}
+
+func TestSourcePortRefusedOverStreams(t *testing.T) {
+	source := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), 5353)
+	cases := []struct {
+		mode   Mode
+		server string
+	}{
+		{mode: ModeTCP, server: "127.0.0.1:53"},
+		{mode: ModeDoT, server: "127.0.0.1:853"},
+		{mode: ModeUDP, server: "https://127.0.0.1/dns-query"},
+	}
+	for _, tc := range cases {
+		client := New(Options{Mode: tc.mode, Timeout: time.Second, Source: source})
+		_, _, _, err := client.Exchange(context.Background(), tc.server, client.BuildQuery("example.com.", dns.TypeA))
+		client.Close()
+		if !errors.Is(err, errSourcePort) {
+			t.Fatalf("%s %s: expected errSourcePort, got %v", tc.mode, tc.server, err)
+		}
+	}
+}
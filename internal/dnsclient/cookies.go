@@ -0,0 +1,122 @@
+package dnsclient
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	CookieSupported = "supported"
+	CookieIgnored   = "ignored"
+	CookieMismatch  = "mismatch"
+	CookieMalformed = "malformed"
+	CookieBad       = "badcookie"
+)
+
+// cookieJar holds the client secret and the server cookies learned so far
+// (RFC 7873). Client cookies are derived per server IP from the secret.
+type cookieJar struct {
+	secret []byte
+
+	mu      sync.Mutex
+	servers map[string]string
+}
+
+func newCookieJar() *cookieJar {
+	secret := make([]byte, 16)
+	_, _ = rand.Read(secret)
+	return &cookieJar{secret: secret, servers: map[string]string{}}
+}
+
+func (j *cookieJar) clientCookie(server string) string {
+	host := server
+	if h, _, err := net.SplitHostPort(server); err == nil {
+		host = h
+	}
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// attach adds a COOKIE option with the client cookie for server and, when one
+// is known, the server cookie returned earlier.
+func (j *cookieJar) attach(msg *dns.Msg, server string) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(1232, false)
+		opt = msg.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0COOKIE {
+			options = append(options, option)
+		}
+	}
+	j.mu.Lock()
+	serverCookie := j.servers[server]
+	j.mu.Unlock()
+	opt.Option = append(options, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: j.clientCookie(server) + serverCookie})
+}
+
+// learn stores the server cookie from resp when its client half matches.
+func (j *cookieJar) learn(server string, req, resp *dns.Msg) bool {
+	sent := cookieValue(req)
+	got := cookieValue(resp)
+	if len(sent) < 16 || len(got) < 32 || !strings.EqualFold(sent[:16], got[:16]) {
+		return false
+	}
+	j.mu.Lock()
+	j.servers[server] = got[16:]
+	j.mu.Unlock()
+	return true
+}
+
+// CookieStatus reports how a server handled the COOKIE option in req. It
+// returns an empty string when no cookie was sent.
+func CookieStatus(req, resp *dns.Msg) string {
+	sent := cookieValue(req)
+	if sent == "" || resp == nil {
+		return ""
+	}
+	got := cookieValue(resp)
+	if got == "" {
+		if resp.Rcode == dns.RcodeBadCookie {
+			return CookieBad
+		}
+		return CookieIgnored
+	}
+	// A server cookie is 8 to 32 bytes, so the hex option is 32 to 80 chars.
+	if len(got) < 32 || len(got) > 80 {
+		return CookieMalformed
+	}
+	if !strings.EqualFold(sent[:16], got[:16]) {
+		return CookieMismatch
+	}
+	if resp.Rcode == dns.RcodeBadCookie {
+		return CookieBad
+	}
+	return CookieSupported
+}
+
+func cookieValue(msg *dns.Msg) string {
+	if msg == nil {
+		return ""
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+			return cookie.Cookie
+		}
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package dnsclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+type dohTransport struct {
+	method string
+	client *http.Client
+}
+
+func newDoHTransport(timeout time.Duration, method string, tlsConfig *tls.Config, bind binding) *dohTransport {
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+	}
+	return &dohTransport{
+		method: strings.ToUpper(method),
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         bind.dialer("tcp", timeout).DialContext,
+				TLSClientConfig:     tlsConfig,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     30 * time.Second,
+			},
+		},
+	}
+}
+
+func (t *dohTransport) Exchange(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	id := msg.Id
+	// RFC 8484 recommends ID 0 so identical GET requests stay cacheable.
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var req *http.Request
+	if t.method == "GET" {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, expandDoHTemplate(server, base64.RawURLEncoding.EncodeToString(packed)), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, expandDoHTemplate(server, ""), bytes.NewReader(packed))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	httpResp, err := t.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("doh server returned http %d", httpResp.StatusCode)
+	}
+	if contentType := httpResp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, dohMediaType) {
+		return nil, rtt, fmt.Errorf("unexpected doh content type %q", contentType)
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	resp.Id = id
+	return resp, rtt, nil
+}
+
+// expandDoHTemplate fills the RFC 6570 {?dns} variable used by DoH URL
+// templates. An empty value drops the variable, which is what POST needs.
+func expandDoHTemplate(template string, value string) string {
+	base := template
+	if idx := strings.Index(base, "{"); idx >= 0 {
+		base = base[:idx]
+	}
+	if value == "" {
+		return base
+	}
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "dns=" + value
+}
+
+func isDoHURL(server string) bool {
+	return strings.HasPrefix(strings.ToLower(server), "https://")
+}
+
+func dohURL(server string) string {
+	if isDoHURL(server) {
+		return server
+	}
+	host := strings.TrimSuffix(normalizeServer(server, "443"), ":443")
+	return "https://" + host + "/dns-query{?dns}"
+}
+
+func (t *dohTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
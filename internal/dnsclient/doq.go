@@ -0,0 +1,126 @@
+package dnsclient
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	doqALPN    = "doq"
+	doqNoError = quic.ApplicationErrorCode(0)
+)
+
+// handshakeTransport is implemented by transports that set up a session
+// before each query, so the handshake can be reported apart from the RTT.
+type handshakeTransport interface {
+	ExchangeWithHandshake(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, time.Duration, error)
+}
+
+type doqTransport struct {
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	bind      binding
+}
+
+func (t *doqTransport) Exchange(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	resp, rtt, _, err := t.ExchangeWithHandshake(ctx, server, msg)
+	return resp, rtt, err
+}
+
+func (t *doqTransport) ExchangeWithHandshake(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok && t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	tlsConfig := tlsConfigForServer(t.tlsConfig, server)
+	tlsConfig.NextProtos = []string{doqALPN}
+
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	packetConn, err := t.bind.listenPacket(ctx)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer packetConn.Close()
+
+	start := time.Now()
+	conn, err := quic.Dial(ctx, packetConn, raddr, tlsConfig, &quic.Config{})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	handshake := time.Since(start)
+	defer conn.CloseWithError(doqNoError, "")
+	stop := context.AfterFunc(ctx, func() { conn.CloseWithError(doqNoError, "") })
+	defer stop()
+
+	id := msg.Id
+	// RFC 9250 requires the DNS message ID to be 0 on DoQ streams.
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, handshake, err
+	}
+
+	start = time.Now()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, 0, handshake, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	frame := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+	copy(frame[2:], packed)
+	if _, err := stream.Write(frame); err != nil {
+		return nil, 0, handshake, err
+	}
+	// Closing the send side tells the server no further queries follow.
+	if err := stream.Close(); err != nil {
+		return nil, 0, handshake, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, time.Since(start), handshake, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, time.Since(start), handshake, err
+	}
+	rtt := time.Since(start)
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, rtt, handshake, err
+	}
+	if resp.Id != 0 {
+		return nil, rtt, handshake, fmt.Errorf("doq response id %d, expected 0", resp.Id)
+	}
+	resp.Id = id
+	return resp, rtt, handshake, nil
+}
+
+func isDoQURL(server string) bool {
+	return strings.HasPrefix(strings.ToLower(server), "quic://")
+}
+
+func doqURL(server string) string {
+	if isDoQURL(server) {
+		server = server[len("quic://"):]
+	}
+	return "quic://" + normalizeServer(server, "853")
+}
@@ -0,0 +1,107 @@
+package dnsclient
+
+import (
+	"encoding/hex"
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// SetClientSubnet attaches an EDNS Client Subnet option (RFC 7871) for
+// prefix, replacing any subnet option already on msg.
+func SetClientSubnet(msg *dns.Msg, prefix netip.Prefix) {
+	if !prefix.IsValid() {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(1232, false)
+		opt = msg.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0SUBNET {
+			options = append(options, option)
+		}
+	}
+	prefix = prefix.Masked()
+	family := uint16(1)
+	if !prefix.Addr().Is4() {
+		family = 2
+	}
+	opt.Option = append(options, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	})
+}
+
+// RequestNSID asks the server to identify itself (RFC 5001).
+func RequestNSID(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(1232, false)
+		opt = msg.IsEdns0()
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0NSID {
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+}
+
+// NSID returns the server identifier from a response. Printable identifiers
+// are returned as text, anything else as hex.
+func NSID(msg *dns.Msg) string {
+	if msg == nil {
+		return ""
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		nsid, ok := option.(*dns.EDNS0_NSID)
+		if !ok || nsid.Nsid == "" {
+			continue
+		}
+		raw, err := hex.DecodeString(nsid.Nsid)
+		if err != nil || !printable(raw) {
+			return nsid.Nsid
+		}
+		return string(raw)
+	}
+	return ""
+}
+
+func printable(raw []byte) bool {
+	for _, b := range raw {
+		if b < 0x20 || b > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientSubnetScope returns the subnet echoed in a response's EDNS Client
+// Subnet option along with the scope prefix length the server applied.
+func ClientSubnetScope(msg *dns.Msg) (string, int, bool) {
+	if msg == nil {
+		return "", 0, false
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return "", 0, false
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			addr, _ := netip.AddrFromSlice(subnet.Address)
+			prefix := netip.PrefixFrom(addr.Unmap(), int(subnet.SourceNetmask))
+			return prefix.String(), int(subnet.SourceScope), true
+		}
+	}
+	return "", 0, false
+}
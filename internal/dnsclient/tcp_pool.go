@@ -0,0 +1,300 @@
+package dnsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errConnClosed = errors.New("tcp connection closed")
+
+// pooledTCPTransport keeps one connection per server and pipelines queries
+// on it. Responses are matched by message ID and question, so servers may
+// answer out of order as RFC 7766 allows. Connections are dialled under the
+// pool's own context so that one caller giving up does not fail the others
+// waiting on the same dial.
+type pooledTCPTransport struct {
+	timeout     time.Duration
+	idleTimeout time.Duration
+	bind        binding
+
+	mu     sync.Mutex
+	conns  map[string]*pipelinedConn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type pipelinedConn struct {
+	ready chan struct{}
+	conn  *dns.Conn
+	err   error
+	used  bool
+
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	pending     map[uint16]pendingQuery
+	closed      bool
+	idle        *time.Timer
+	idleTimeout time.Duration
+}
+
+// pendingQuery is a query waiting for its response on a pipelined connection.
+type pendingQuery struct {
+	question []dns.Question
+	ch       chan pipelinedResult
+}
+
+type pipelinedResult struct {
+	msg *dns.Msg
+	at  time.Time
+	err error
+}
+
+func newPooledTCPTransport(timeout time.Duration, bind binding) *pooledTCPTransport {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pooledTCPTransport{timeout: timeout, idleTimeout: 5 * time.Second, bind: bind, ctx: ctx, cancel: cancel}
+}
+
+func (t *pooledTCPTransport) Exchange(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok && t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	pc, err := t.conn(ctx, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	reused := pc.markUsed()
+	resp, rtt, err := pc.exchange(ctx, msg)
+	if err != nil && reused && errors.Is(err, errConnClosed) && ctx.Err() == nil {
+		// The server may have dropped an idle connection; retry on a fresh one.
+		pc, err = t.conn(ctx, server)
+		if err != nil {
+			return nil, 0, err
+		}
+		pc.markUsed()
+		return pc.exchange(ctx, msg)
+	}
+	return resp, rtt, err
+}
+
+func (t *pooledTCPTransport) conn(ctx context.Context, server string) (*pipelinedConn, error) {
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = map[string]*pipelinedConn{}
+	}
+	pc, ok := t.conns[server]
+	if ok && pc.isClosed() {
+		delete(t.conns, server)
+		ok = false
+	}
+	if !ok {
+		pc = &pipelinedConn{ready: make(chan struct{}), pending: map[uint16]pendingQuery{}, idleTimeout: t.idleTimeout}
+		t.conns[server] = pc
+		dialCtx := t.ctx
+		t.mu.Unlock()
+		go t.dial(dialCtx, server, pc)
+	} else {
+		t.mu.Unlock()
+	}
+
+	select {
+	case <-pc.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if pc.err != nil {
+		return nil, pc.err
+	}
+	return pc, nil
+}
+
+func (t *pooledTCPTransport) dial(ctx context.Context, server string, pc *pipelinedConn) {
+	defer close(pc.ready)
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	client := &dns.Client{Net: "tcp", Timeout: t.timeout, Dialer: t.bind.dialer("tcp", t.timeout)}
+	conn, err := client.DialContext(ctx, server)
+	if err != nil {
+		pc.err = err
+		pc.mu.Lock()
+		pc.closed = true
+		pc.mu.Unlock()
+		t.forget(server, pc)
+		return
+	}
+	pc.conn = conn
+	pc.idle = time.AfterFunc(pc.idleTimeout, pc.closeIfIdle)
+	go func() {
+		pc.readLoop()
+		t.forget(server, pc)
+	}()
+}
+
+func (t *pooledTCPTransport) forget(server string, pc *pipelinedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[server] == pc {
+		delete(t.conns, server)
+	}
+}
+
+// Close cancels dials in progress and closes every pooled connection. The
+// transport stays usable and dials afresh afterwards.
+func (t *pooledTCPTransport) Close() error {
+	t.mu.Lock()
+	conns := t.conns
+	t.conns = nil
+	t.cancel()
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.mu.Unlock()
+	for _, pc := range conns {
+		<-pc.ready
+		pc.shutdown(errConnClosed)
+	}
+	return nil
+}
+
+func (pc *pipelinedConn) markUsed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	used := pc.used
+	pc.used = true
+	return used
+}
+
+func (pc *pipelinedConn) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.closed
+}
+
+func (pc *pipelinedConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	id := msg.Id
+	ch := make(chan pipelinedResult, 1)
+
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return nil, 0, errConnClosed
+	}
+	for {
+		if _, busy := pc.pending[msg.Id]; !busy {
+			break
+		}
+		msg.Id = dns.Id()
+	}
+	wireID := msg.Id
+	pc.pending[wireID] = pendingQuery{question: msg.Question, ch: ch}
+	pc.idle.Stop()
+	pc.mu.Unlock()
+	defer pc.release(wireID)
+
+	start := time.Now()
+	pc.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = pc.conn.SetWriteDeadline(deadline)
+	err := pc.conn.WriteMsg(msg)
+	pc.writeMu.Unlock()
+	msg.Id = id
+	if err != nil {
+		// Wrap the write error so Exchange retries a reused connection the
+		// server has half-closed (EPIPE, ECONNRESET).
+		pc.shutdown(errConnClosed)
+		return nil, 0, fmt.Errorf("%w: %v", errConnClosed, err)
+	}
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, time.Since(start), res.err
+		}
+		res.msg.Id = id
+		return res.msg, res.at.Sub(start), nil
+	case <-ctx.Done():
+		return nil, time.Since(start), ctx.Err()
+	}
+}
+
+func (pc *pipelinedConn) release(id uint16) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.pending, id)
+	if len(pc.pending) == 0 && !pc.closed {
+		pc.idle.Reset(pc.idleTimeout)
+	}
+}
+
+func (pc *pipelinedConn) readLoop() {
+	for {
+		resp, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.shutdown(errConnClosed)
+			return
+		}
+		at := time.Now()
+		pc.mu.Lock()
+		query, ok := pc.pending[resp.Id]
+		// RFC 7766 section 7: a response must match the ID and the question
+		// of the query; anything else is dropped.
+		ok = ok && sameQuestion(query.question, resp.Question)
+		if ok {
+			delete(pc.pending, resp.Id)
+		}
+		pc.mu.Unlock()
+		if ok {
+			query.ch <- pipelinedResult{msg: resp, at: at}
+		}
+	}
+}
+
+func (pc *pipelinedConn) closeIfIdle() {
+	pc.mu.Lock()
+	idle := len(pc.pending) == 0
+	pc.mu.Unlock()
+	if idle {
+		pc.shutdown(errConnClosed)
+	}
+}
+
+func (pc *pipelinedConn) shutdown(err error) {
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return
+	}
+	pc.closed = true
+	pending := pc.pending
+	pc.pending = map[uint16]pendingQuery{}
+	pc.mu.Unlock()
+
+	pc.idle.Stop()
+	pc.conn.Close()
+	for _, query := range pending {
+		query.ch <- pipelinedResult{err: err}
+	}
+}
+
+// sameQuestion compares question sections, ignoring the case of names.
+func sameQuestion(a, b []dns.Question) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i].Name, b[i].Name) || a[i].Qtype != b[i].Qtype || a[i].Qclass != b[i].Qclass {
+			return false
+		}
+	}
+	return true
+}
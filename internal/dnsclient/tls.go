@@ -0,0 +1,98 @@
+package dnsclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type dotTransport struct {
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	bind      binding
+}
+
+func (t *dotTransport) Exchange(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	client := &dns.Client{Net: "tcp-tls", Timeout: t.timeout, TLSConfig: tlsConfigForServer(t.tlsConfig, server), Dialer: t.bind.dialer("tcp", t.timeout)}
+	conn, err := client.DialContext(ctx, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	return exchangeOnConn(ctx, client, conn, msg)
+}
+
+// BuildTLSConfig returns the TLS settings used by encrypted transports. When
+// pins are given without a CA bundle the pins replace PKI validation, which
+// matches the RFC 7858 out-of-band key-pinned profile.
+func BuildTLSConfig(serverName string, caFile string, pins []string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(pins) == 0 {
+		return cfg, nil
+	}
+	wanted := map[string]struct{}{}
+	for _, pin := range pins {
+		pin = strings.TrimSpace(pin)
+		decoded, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin %q: expected base64 sha256", pin)
+		}
+		wanted[pin] = struct{}{}
+	}
+	if caFile == "" {
+		cfg.InsecureSkipVerify = true
+	}
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		for _, cert := range state.PeerCertificates {
+			if _, ok := wanted[SPKIPin(cert)]; ok {
+				return nil
+			}
+		}
+		return errors.New("no certificate in chain matches a pinned spki hash")
+	}
+	return cfg, nil
+}
+
+// SPKIPin returns the base64 SHA-256 digest of the certificate's
+// SubjectPublicKeyInfo, the format accepted by BuildTLSConfig.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func tlsConfigForServer(base *tls.Config, server string) *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(server); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	return cfg
+}
@@ -2,6 +2,7 @@ package dnsclient
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/miekg/dns"
@@ -13,24 +14,36 @@ type Transport interface {
 
 type udpTransport struct {
 	timeout time.Duration
+	bind    binding
 }
 
 func (t *udpTransport) Exchange(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
-	client := &dns.Client{Net: "udp", Timeout: t.timeout}
-	if deadline, ok := ctx.Deadline(); ok {
-		client.Timeout = time.Until(deadline)
+	client := &dns.Client{Net: "udp", Timeout: t.timeout, Dialer: t.bind.dialer("udp", t.timeout)}
+	conn, err := client.DialContext(ctx, server)
+	if err != nil {
+		return nil, 0, err
 	}
-	return client.Exchange(msg, server)
+	defer conn.Close()
+	return exchangeOnConn(ctx, client, conn, msg)
 }
 
-type tcpTransport struct {
-	timeout time.Duration
+// exchangeOnConn runs a single exchange and closes the connection as soon as
+// ctx is cancelled, so callers do not wait for the read deadline.
+func exchangeOnConn(ctx context.Context, client *dns.Client, conn *dns.Conn, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	resp, rtt, err := client.ExchangeWithConnContext(ctx, msg, conn)
+	if !stop() {
+		return nil, rtt, ctx.Err()
+	}
+	return resp, rtt, err
 }
 
-func (t *tcpTransport) Exchange(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
-	client := &dns.Client{Net: "tcp", Timeout: t.timeout}
-	if deadline, ok := ctx.Deadline(); ok {
-		client.Timeout = time.Until(deadline)
+func closeTransport(transport Transport) error {
+	if closer, ok := transport.(io.Closer); ok {
+		return closer.Close()
 	}
-	return client.Exchange(msg, server)
+	return nil
 }
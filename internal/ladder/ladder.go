@@ -3,6 +3,8 @@ package ladder
 import (
 	"context"
 	"fmt"
+	"net/netip"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 
 type Config struct {
 	Timeout time.Duration
+	Subnets []netip.Prefix
 	Logger  *zap.Logger
 }
 
@@ -33,50 +36,127 @@ func Trace(ctx context.Context, client *dnsclient.Client, resolvers []string, fq
 		cfg.Logger = zap.NewNop()
 	}
 
+	subnets := cfg.Subnets
+	if len(subnets) == 0 {
+		subnets = []netip.Prefix{{}}
+	}
+
 	result := model.TraceResult{}
-	for i, resolver := range resolvers {
-		resolver = dnsclient.NormalizeServer(resolver)
-		query := client.BuildQuery(fqdn, qtype)
-		query.RecursionDesired = true
-
-		ctxReq, cancel := context.WithTimeout(ctx, cfg.Timeout)
-		resp, rtt, transport, err := client.Exchange(ctxReq, resolver, query)
-		cancel()
-
-		step := model.TraceStep{
-			Index:     i,
-			Server:    resolver,
-			QueryName: dns.Fqdn(fqdn),
-			QueryType: dns.TypeToString[qtype],
-			Transport: transport,
-			RTT:       rtt.String(),
-			Timestamp: time.Now(),
+	for _, resolver := range resolvers {
+		resolver = client.NormalizeServer(resolver)
+		for _, subnet := range subnets {
+			step, timing := queryResolver(ctx, client, resolver, fqdn, qtype, subnet, len(result.TraceSteps), cfg)
+			result.TraceSteps = append(result.TraceSteps, step)
+			result.Timings = append(result.Timings, timing)
 		}
+	}
 
-		if err != nil {
-			step.Error = err.Error()
-			result.TraceSteps = append(result.TraceSteps, step)
-			result.Timings = append(result.Timings, model.Timing{StepIndex: i, Server: resolver, RTT: rtt.String(), TimedOut: true, Transport: transport})
-			continue
+	result.Diagnosis = diagnoseLadder(result)
+	if len(cfg.Subnets) > 0 {
+		result.Diagnosis.Hints = append(result.Diagnosis.Hints, compareSubnets(result.TraceSteps)...)
+	}
+	return result, nil
+}
+
+func queryResolver(ctx context.Context, client *dnsclient.Client, resolver string, fqdn string, qtype uint16, subnet netip.Prefix, index int, cfg Config) (model.TraceStep, model.Timing) {
+	query := client.BuildQuery(fqdn, qtype)
+	query.RecursionDesired = true
+	dnsclient.SetClientSubnet(query, subnet)
+
+	ctxReq, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	resp, rtt, handshake, transport, err := client.ExchangeWithHandshake(ctxReq, resolver, query)
+	cancel()
+
+	step := model.TraceStep{
+		Index:     index,
+		Server:    resolver,
+		QueryName: dns.Fqdn(fqdn),
+		QueryType: dns.TypeToString[qtype],
+		Transport: transport,
+		RTT:       rtt.String(),
+		Timestamp: time.Now(),
+	}
+	if subnet.IsValid() {
+		step.ClientSubnet = subnet.Masked().String()
+	}
+
+	if err != nil {
+		step.Error = err.Error()
+		return step, model.Timing{StepIndex: index, Server: resolver, RTT: rtt.String(), Handshake: handshakeString(handshake), TimedOut: true, Transport: transport}
+	}
+
+	if resp != nil {
+		step.Authoritative = resp.Authoritative
+		step.Rcode = dns.RcodeToString[resp.Rcode]
+		step.Answers = rrStrings(resp.Answer)
+		step.NS = nsStrings(resp.Ns)
+		step.SOA = soaString(resp)
+		if echoed, scope, ok := dnsclient.ClientSubnetScope(resp); ok {
+			step.ClientSubnet = echoed
+			step.ECSScope = &scope
+		}
+		step.NSID = dnsclient.NSID(resp)
+		step.Cookie = dnsclient.CookieStatus(query, resp)
+		if isReferral(resp) {
+			step.Note = "referral (expected at delegation level)"
+		}
+	}
+
+	return step, model.Timing{StepIndex: index, Server: resolver, RTT: rtt.String(), Handshake: handshakeString(handshake), TimedOut: false, Transport: transport}
+}
+
+// compareSubnets reports, per resolver, whether the answers changed with the
+// client subnet that was sent.
+func compareSubnets(steps []model.TraceStep) []string {
+	order := []string{}
+	bySubnet := map[string][]model.TraceStep{}
+	for _, step := range steps {
+		if _, ok := bySubnet[step.Server]; !ok {
+			order = append(order, step.Server)
 		}
+		bySubnet[step.Server] = append(bySubnet[step.Server], step)
+	}
 
-		if resp != nil {
-			step.Authoritative = resp.Authoritative
-			step.Rcode = dns.RcodeToString[resp.Rcode]
-			step.Answers = rrStrings(resp.Answer)
-			step.NS = nsStrings(resp.Ns)
-			step.SOA = soaString(resp)
-			if isReferral(resp) {
-				step.Note = "referral (expected at delegation level)"
+	hints := []string{}
+	for _, server := range order {
+		group := bySubnet[server]
+		distinct := map[string]struct{}{}
+		parts := []string{}
+		for _, step := range group {
+			key := answerKey(step)
+			distinct[key] = struct{}{}
+			part := fmt.Sprintf("%s => %s", step.ClientSubnet, key)
+			if step.ECSScope != nil {
+				part += fmt.Sprintf(" (scope /%d)", *step.ECSScope)
 			}
+			parts = append(parts, part)
 		}
-
-		result.TraceSteps = append(result.TraceSteps, step)
-		result.Timings = append(result.Timings, model.Timing{StepIndex: i, Server: resolver, RTT: rtt.String(), TimedOut: false, Transport: transport})
+		if len(distinct) <= 1 {
+			hints = append(hints, fmt.Sprintf("%s answers identical across %d subnets", server, len(group)))
+			continue
+		}
+		hints = append(hints, fmt.Sprintf("%s answers differ by subnet: %s", server, strings.Join(parts, "; ")))
 	}
+	return hints
+}
 
-	result.Diagnosis = diagnoseLadder(result)
-	return result, nil
+func answerKey(step model.TraceStep) string {
+	if step.Error != "" {
+		return "error"
+	}
+	if len(step.Answers) == 0 {
+		return step.Rcode
+	}
+	rdata := make([]string, 0, len(step.Answers))
+	for _, answer := range step.Answers {
+		fields := strings.Fields(answer)
+		if len(fields) > 3 {
+			fields = fields[3:]
+		}
+		rdata = append(rdata, strings.Join(fields, " "))
+	}
+	sort.Strings(rdata)
+	return strings.Join(rdata, ", ")
 }
 
 func diagnoseLadder(result model.TraceResult) model.Diagnosis {
@@ -126,6 +206,13 @@ func diagnoseLadder(result model.TraceResult) model.Diagnosis {
 	}
 }
 
+func handshakeString(handshake time.Duration) string {
+	if handshake == 0 {
+		return ""
+	}
+	return handshake.String()
+}
+
 func hasAnswer(step model.TraceStep) bool {
 	return len(step.Answers) > 0
 }
@@ -3,8 +3,10 @@ package ladder
 import (
 	"context"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -83,3 +85,42 @@ func TestReferralNote(t *testing.T) {
 		t.Fatalf("expected referral note to be set")
 	}
 }
+
+func TestLadderComparesClientSubnets(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		subnet, _, _ := dnsclient.ClientSubnetScope(msg)
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		answer := "203.0.113.10"
+		if subnet == "198.51.100.0/24" {
+			answer = "203.0.113.20"
+		}
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(answer)}}
+		resp.SetEdns0(1232, false)
+		dnsclient.SetClientSubnet(resp, netip.MustParsePrefix(subnet))
+		resp.IsEdns0().Option[0].(*dns.EDNS0_SUBNET).SourceScope = 20
+		return resp, 5 * time.Millisecond, nil
+	}}
+
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	subnets := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("198.51.100.0/24")}
+	result, err := Trace(context.Background(), client, []string{"1.1.1.1"}, "example.com", "A", Config{Timeout: time.Second, Subnets: subnets})
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if len(result.TraceSteps) != 2 {
+		t.Fatalf("expected one step per subnet, got %d", len(result.TraceSteps))
+	}
+	if step := result.TraceSteps[1]; step.ClientSubnet != "198.51.100.0/24" || step.ECSScope == nil || *step.ECSScope != 20 {
+		t.Fatalf("unexpected subnet details: %#v", step)
+	}
+	found := false
+	for _, hint := range result.Diagnosis.Hints {
+		if strings.Contains(hint, "answers differ by subnet") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected subnet difference hint, got %#v", result.Diagnosis.Hints)
+	}
+}
@@ -6,6 +6,8 @@ type TraceStep struct {
 	Index         int       `json:"index"`
 	Server        string    `json:"server"`
 	ServerName    string    `json:"server_name,omitempty"`
+	Zone          string    `json:"zone,omitempty"`
+	Family        string    `json:"family,omitempty"`
 	QueryName     string    `json:"query_name"`
 	QueryType     string    `json:"query_type"`
 	Transport     string    `json:"transport"`
@@ -14,6 +16,12 @@ type TraceStep struct {
 	Answers       []string  `json:"answers,omitempty"`
 	NS            []string  `json:"ns,omitempty"`
 	SOA           string    `json:"soa,omitempty"`
+	ClientSubnet  string    `json:"client_subnet,omitempty"`
+	ECSScope      *int      `json:"ecs_scope,omitempty"`
+	NSID          string    `json:"nsid,omitempty"`
+	Cookie        string    `json:"cookie,omitempty"`
+	DNSSEC        string    `json:"dnssec,omitempty"`
+	Cached        bool      `json:"cached,omitempty"`
 	RTT           string    `json:"rtt"`
 	Error         string    `json:"error,omitempty"`
 	Note          string    `json:"note,omitempty"`
@@ -24,6 +32,7 @@ type Timing struct {
 	StepIndex int    `json:"step_index"`
 	Server    string `json:"server"`
 	RTT       string `json:"rtt"`
+	Handshake string `json:"handshake,omitempty"`
 	TimedOut  bool   `json:"timed_out"`
 	Transport string `json:"transport"`
 }
@@ -32,11 +41,142 @@ type Diagnosis struct {
 	Classification string   `json:"classification"`
 	Summary        string   `json:"summary"`
 	EvidenceSteps  []int    `json:"evidence_steps"`
+	Records        []string `json:"records,omitempty"`
+	Warnings       []string `json:"warnings,omitempty"`
 	Hints          []string `json:"hints,omitempty"`
 }
 
+type CookieCheck struct {
+	Server     string `json:"server"`
+	ServerName string `json:"server_name,omitempty"`
+	Status     string `json:"status"`
+	Queries    int    `json:"queries"`
+}
+
 type TraceResult struct {
+	TraceSteps  []TraceStep       `json:"trace_steps"`
+	Diagnosis   Diagnosis         `json:"diagnosis"`
+	Timings     []Timing          `json:"timings"`
+	Cookies     []CookieCheck     `json:"cookies,omitempty"`
+	Paths       *PathZone         `json:"paths,omitempty"`
+	SOA         []SOACheck        `json:"soa,omitempty"`
+	Nameservers []NameserverCheck `json:"nameservers,omitempty"`
+	SubTraces   []SubTrace        `json:"sub_traces,omitempty"`
+	Types       []TypeResult      `json:"types,omitempty"`
+}
+
+// TypeResult is the answer for one record type of a multi-type trace. Step
+// is the query that produced it.
+type TypeResult struct {
+	QueryType string    `json:"query_type"`
+	Step      int       `json:"step"`
+	Rcode     string    `json:"rcode,omitempty"`
+	Answers   []string  `json:"answers,omitempty"`
+	Diagnosis Diagnosis `json:"diagnosis"`
+}
+
+// SubTrace is a nameserver address lookup made to follow a delegation
+// without usable glue. ParentStep is the step that needed the address.
+type SubTrace struct {
+	ParentStep int         `json:"parent_step"`
+	Name       string      `json:"name"`
+	QueryType  string      `json:"query_type"`
+	Addresses  []string    `json:"addresses,omitempty"`
+	Error      string      `json:"error,omitempty"`
 	TraceSteps []TraceStep `json:"trace_steps"`
-	Diagnosis  Diagnosis   `json:"diagnosis"`
-	Timings    []Timing    `json:"timings"`
+	SubTraces  []SubTrace  `json:"sub_traces,omitempty"`
+}
+
+// NameserverCheck is how one address of a nameserver for the final zone
+// answered for the zone apex. Status is authoritative, lame, unreachable or
+// wrong-zone.
+type NameserverCheck struct {
+	Server     string `json:"server,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	Family     string `json:"family,omitempty"`
+	Step       int    `json:"step"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+// SOACheck is the SOA one address of a nameserver returned for the final
+// zone. Status is ok, behind, mismatch or error.
+type SOACheck struct {
+	Server     string `json:"server"`
+	ServerName string `json:"server_name,omitempty"`
+	Family     string `json:"family"`
+	Step       int    `json:"step"`
+	Serial     uint32 `json:"serial"`
+	MName      string `json:"mname,omitempty"`
+	Refresh    uint32 `json:"refresh"`
+	Retry      uint32 `json:"retry"`
+	Expire     uint32 `json:"expire"`
+	Minimum    uint32 `json:"minimum"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// PathZone is a zone in an all-paths delegation tree and the nameservers that
+// were asked about it.
+type PathZone struct {
+	Zone    string     `json:"zone"`
+	Servers []PathNode `json:"servers"`
+}
+
+// PathNode is one nameserver's answer within a PathZone. Referral is set on
+// the first server to return each distinct referral.
+type PathNode struct {
+	Server     string    `json:"server"`
+	ServerName string    `json:"server_name,omitempty"`
+	Step       int       `json:"step"`
+	Outcome    string    `json:"outcome"`
+	Issue      string    `json:"issue,omitempty"`
+	Referral   *PathZone `json:"referral,omitempty"`
+}
+
+type KeyInfo struct {
+	KeyTag    uint16 `json:"key_tag"`
+	Algorithm string `json:"algorithm"`
+	Flags     uint16 `json:"flags"`
+	Role      string `json:"role"`
+	MatchesDS bool   `json:"matches_ds"`
+	Signing   bool   `json:"signing"`
+	Standby   bool   `json:"standby"`
+	Revoked   bool   `json:"revoked"`
+}
+
+type DSInfo struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  string `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	MatchesKey bool   `json:"matches_key"`
+	ActiveKSK  bool   `json:"active_ksk"`
+}
+
+type SignatureInfo struct {
+	Owner      string    `json:"owner"`
+	Covers     string    `json:"covers"`
+	KeyTag     uint16    `json:"key_tag"`
+	Inception  time.Time `json:"inception"`
+	Expiration time.Time `json:"expiration"`
+	Remaining  string    `json:"remaining"`
+	Status     string    `json:"status"`
+}
+
+type ZoneHealth struct {
+	Zone          string          `json:"zone"`
+	Status        string          `json:"status"`
+	DS            []DSInfo        `json:"ds,omitempty"`
+	Keys          []KeyInfo       `json:"keys,omitempty"`
+	Signatures    []SignatureInfo `json:"signatures,omitempty"`
+	Issues        []string        `json:"issues,omitempty"`
+	EvidenceSteps []int           `json:"evidence_steps,omitempty"`
+}
+
+type HealthReport struct {
+	Zone       string       `json:"zone"`
+	Zones      []ZoneHealth `json:"zones"`
+	Diagnosis  Diagnosis    `json:"diagnosis"`
+	TraceSteps []TraceStep  `json:"trace_steps"`
+	Timings    []Timing     `json:"timings"`
 }
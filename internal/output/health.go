@@ -0,0 +1,75 @@
+package output
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+)
+
+func RenderHealthPretty(report model.HealthReport) string {
+	title := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("205")).Render("dnstrace dnssec-health")
+	zoneStyle := lipgloss.NewStyle().Bold(true)
+	stepStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("252"))
+	successStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("42"))
+	failureStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("196"))
+
+	lines := []string{title, ""}
+	for _, zone := range report.Zones {
+		lines = append(lines, zoneStyle.Render(fmt.Sprintf("%s %s", zone.Zone, zone.Status)))
+		for _, ds := range zone.DS {
+			label := successStyle.Render("OK")
+			if !ds.ActiveKSK {
+				label = failureStyle.Render("WARN")
+			}
+			line := fmt.Sprintf("DS key=%d alg=%s digest=%d matches_key=%t active_ksk=%t", ds.KeyTag, ds.Algorithm, ds.DigestType, ds.MatchesKey, ds.ActiveKSK)
+			lines = append(lines, "  "+label+" "+stepStyle.Render(line))
+		}
+		for _, key := range zone.Keys {
+			state := "active"
+			switch {
+			case key.Revoked:
+				state = "revoked"
+			case key.Standby:
+				state = "standby"
+			}
+			line := fmt.Sprintf("DNSKEY %s key=%d alg=%s flags=%d %s", key.Role, key.KeyTag, key.Algorithm, key.Flags, state)
+			if key.MatchesDS {
+				line += " ds"
+			}
+			lines = append(lines, "  "+stepStyle.Render(line))
+		}
+		for _, sig := range zone.Signatures {
+			label := successStyle.Render("OK")
+			if sig.Status != "ok" {
+				label = failureStyle.Render(strings.ToUpper(sig.Status))
+			}
+			line := fmt.Sprintf("RRSIG %s %s key=%d %s -> %s remaining=%s", sig.Owner, sig.Covers, sig.KeyTag, sig.Inception.Format(time.RFC3339), sig.Expiration.Format(time.RFC3339), sig.Remaining)
+			lines = append(lines, "  "+label+" "+stepStyle.Render(line))
+		}
+		lines = append(lines, "")
+	}
+
+	summary := fmt.Sprintf("%s %s", report.Diagnosis.Classification, report.Diagnosis.Summary)
+	if report.Diagnosis.Classification == "SUCCESS" {
+		lines = append(lines, successStyle.Render(summary))
+	} else {
+		lines = append(lines, failureStyle.Render(summary))
+	}
+	if len(report.Diagnosis.Warnings) > 0 {
+		lines = append(lines, "Warnings:")
+		for _, warning := range report.Diagnosis.Warnings {
+			lines = append(lines, "- "+warning)
+		}
+	}
+	if len(report.Diagnosis.Hints) > 0 {
+		lines = append(lines, "Hints:")
+		for _, hint := range report.Diagnosis.Hints {
+			lines = append(lines, "- "+hint)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
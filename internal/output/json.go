@@ -1,12 +1,8 @@
 package output
 
-import (
-	"encoding/json"
+import "encoding/json"
 
-	"github.com/jaxxstorm/dnstrace/internal/model"
-)
-
-func RenderJSON(result model.TraceResult) (string, error) {
+func RenderJSON(result any) (string, error) {
 	b, err := json.MarshalIndent(result, "", "  ")
 	if err != nil {
 		return "", err
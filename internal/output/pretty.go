@@ -15,36 +15,88 @@ func RenderPretty(result model.TraceResult) string {
 	failureStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("196"))
 
 	lines := []string{title, ""}
-	for _, step := range result.TraceSteps {
-		statusLabel := successStyle.Render("OK")
-		if step.Error != "" {
-			statusLabel = failureStyle.Render("FAIL")
-		}
-		serverDisplay := step.Server
-		if step.ServerName != "" {
-			serverDisplay = fmt.Sprintf("%s (%s)", step.Server, step.ServerName)
-		}
-		line := fmt.Sprintf("%s %02d %s %s %s -> %s", statusLabel, step.Index+1, serverDisplay, step.QueryName, step.QueryType, step.Rcode)
-		if step.Error != "" {
-			line = fmt.Sprintf("%s %02d %s %s %s -> error: %s", statusLabel, step.Index+1, serverDisplay, step.QueryName, step.QueryType, step.Error)
-		}
-		if step.Authoritative {
-			line += " aa"
+	lines = appendSteps(lines, result.TraceSteps, result.SubTraces, 0, stepStyle, successStyle, failureStyle)
+
+	if len(result.Cookies) > 0 {
+		lines = append(lines, "", "Cookies:")
+		for _, check := range result.Cookies {
+			serverDisplay := check.Server
+			if check.ServerName != "" {
+				serverDisplay = fmt.Sprintf("%s (%s)", check.Server, check.ServerName)
+			}
+			line := fmt.Sprintf("%s %s queries=%d", serverDisplay, check.Status, check.Queries)
+			if check.Status == "supported" {
+				lines = append(lines, successStyle.Render("OK")+" "+stepStyle.Render(line))
+			} else {
+				lines = append(lines, failureStyle.Render("WARN")+" "+stepStyle.Render(line))
+			}
 		}
-		if step.RTT != "" {
-			line += " rtt=" + step.RTT
+	}
+
+	if len(result.Types) > 0 {
+		lines = append(lines, "", "Types:")
+		for _, typeResult := range result.Types {
+			line := fmt.Sprintf("%s %s %s", typeResult.QueryType, typeResult.Diagnosis.Classification, typeResult.Diagnosis.Summary)
+			if typeResult.Step >= 0 {
+				line += fmt.Sprintf(" step=%02d", typeResult.Step+1)
+			}
+			if len(typeResult.Answers) > 0 {
+				normalized := make([]string, 0, len(typeResult.Answers))
+				for _, answer := range typeResult.Answers {
+					normalized = append(normalized, normalizeSpace(answer))
+				}
+				line += " answers=" + strings.Join(normalized, " | ")
+			}
+			switch typeResult.Diagnosis.Classification {
+			case "SUCCESS", "NODATA":
+				lines = append(lines, successStyle.Render("OK")+" "+stepStyle.Render(line))
+			default:
+				lines = append(lines, failureStyle.Render("FAIL")+" "+stepStyle.Render(line))
+			}
 		}
-		if len(step.Answers) > 0 {
-			normalized := make([]string, 0, len(step.Answers))
-			for _, answer := range step.Answers {
-				normalized = append(normalized, normalizeSpace(answer))
+	}
+
+	if len(result.Nameservers) > 0 {
+		lines = append(lines, "", "Nameservers:")
+		for _, check := range result.Nameservers {
+			serverDisplay := check.Server
+			switch {
+			case check.Server == "":
+				serverDisplay = check.ServerName
+			case check.ServerName != "":
+				serverDisplay = fmt.Sprintf("%s (%s)", check.Server, check.ServerName)
+			}
+			line := fmt.Sprintf("%s %s (%s) step=%02d", serverDisplay, check.Status, check.Detail, check.Step+1)
+			if check.Status == "authoritative" {
+				lines = append(lines, successStyle.Render("OK")+" "+stepStyle.Render(line))
+			} else {
+				lines = append(lines, failureStyle.Render("LAME")+" "+stepStyle.Render(line))
 			}
-			line += " answers=" + strings.Join(normalized, " | ")
 		}
-		if step.Note != "" {
-			line += " note=" + step.Note
+	}
+
+	if len(result.SOA) > 0 {
+		lines = append(lines, "", "SOA:")
+		for _, check := range result.SOA {
+			serverDisplay := check.Server
+			if check.ServerName != "" {
+				serverDisplay = fmt.Sprintf("%s (%s)", check.Server, check.ServerName)
+			}
+			line := fmt.Sprintf("%s serial=%d mname=%s refresh=%d retry=%d expire=%d minimum=%d %s", serverDisplay, check.Serial, check.MName, check.Refresh, check.Retry, check.Expire, check.Minimum, check.Status)
+			if check.Error != "" {
+				line = fmt.Sprintf("%s error: %s", serverDisplay, check.Error)
+			}
+			if check.Status == "ok" {
+				lines = append(lines, successStyle.Render("OK")+" "+stepStyle.Render(line))
+			} else {
+				lines = append(lines, failureStyle.Render("WARN")+" "+stepStyle.Render(line))
+			}
 		}
-		lines = append(lines, stepStyle.Render(line))
+	}
+
+	if result.Paths != nil {
+		lines = append(lines, "", "Delegation tree:")
+		lines = appendPaths(lines, result.Paths, 0, successStyle, failureStyle)
 	}
 
 	lines = append(lines, "")
@@ -54,6 +106,18 @@ func RenderPretty(result model.TraceResult) string {
 	} else {
 		lines = append(lines, failureStyle.Render(summary))
 	}
+	if len(result.Diagnosis.Warnings) > 0 {
+		lines = append(lines, "Warnings:")
+		for _, warning := range result.Diagnosis.Warnings {
+			lines = append(lines, "- "+warning)
+		}
+	}
+	if len(result.Diagnosis.Records) > 0 {
+		lines = append(lines, "Records:")
+		for _, record := range result.Diagnosis.Records {
+			lines = append(lines, "- "+normalizeSpace(record))
+		}
+	}
 	if len(result.Diagnosis.Hints) > 0 {
 		lines = append(lines, "Hints:")
 		for _, hint := range result.Diagnosis.Hints {
@@ -64,6 +128,107 @@ func RenderPretty(result model.TraceResult) string {
 	return strings.Join(lines, "\n")
 }
 
+// appendSteps renders steps with the nameserver lookups each one needed
+// nested beneath it.
+func appendSteps(lines []string, steps []model.TraceStep, subTraces []model.SubTrace, depth int, stepStyle, successStyle, failureStyle lipgloss.Style) []string {
+	indent := strings.Repeat("    ", depth)
+	byParent := map[int][]model.SubTrace{}
+	for _, sub := range subTraces {
+		byParent[sub.ParentStep] = append(byParent[sub.ParentStep], sub)
+	}
+	lines = appendSubTraces(lines, byParent[-1], depth, stepStyle, successStyle, failureStyle)
+	for _, step := range steps {
+		lines = append(lines, indent+stepLine(step, stepStyle, successStyle, failureStyle))
+		lines = appendSubTraces(lines, byParent[step.Index], depth, stepStyle, successStyle, failureStyle)
+	}
+	return lines
+}
+
+func appendSubTraces(lines []string, subTraces []model.SubTrace, depth int, stepStyle, successStyle, failureStyle lipgloss.Style) []string {
+	indent := strings.Repeat("    ", depth)
+	for _, sub := range subTraces {
+		line := fmt.Sprintf("%s  └─ %s %s -> %s", indent, sub.Name, sub.QueryType, strings.Join(sub.Addresses, " "))
+		if sub.Error != "" {
+			line = fmt.Sprintf("%s  └─ %s %s -> error: %s", indent, sub.Name, sub.QueryType, sub.Error)
+		}
+		lines = append(lines, stepStyle.Render(line))
+		lines = appendSteps(lines, sub.TraceSteps, sub.SubTraces, depth+1, stepStyle, successStyle, failureStyle)
+	}
+	return lines
+}
+
+func stepLine(step model.TraceStep, stepStyle, successStyle, failureStyle lipgloss.Style) string {
+	statusLabel := successStyle.Render("OK")
+	if step.Error != "" {
+		statusLabel = failureStyle.Render("FAIL")
+	}
+	serverDisplay := step.Server
+	if step.ServerName != "" {
+		serverDisplay = fmt.Sprintf("%s (%s)", step.Server, step.ServerName)
+	}
+	if step.Family != "" {
+		serverDisplay = fmt.Sprintf("[%s] %s", step.Family, serverDisplay)
+	}
+	line := fmt.Sprintf("%s %02d %s %s %s -> %s", statusLabel, step.Index+1, serverDisplay, step.QueryName, step.QueryType, step.Rcode)
+	if step.Error != "" {
+		line = fmt.Sprintf("%s %02d %s %s %s -> error: %s", statusLabel, step.Index+1, serverDisplay, step.QueryName, step.QueryType, step.Error)
+	}
+	if step.Authoritative {
+		line += " aa"
+	}
+	if step.RTT != "" {
+		line += " rtt=" + step.RTT
+	}
+	if step.NSID != "" {
+		line += " nsid=" + step.NSID
+	}
+	if step.Cookie != "" {
+		line += " cookie=" + step.Cookie
+	}
+	if step.DNSSEC != "" {
+		line += " dnssec=" + step.DNSSEC
+	}
+	if step.ClientSubnet != "" {
+		line += " ecs=" + step.ClientSubnet
+		if step.ECSScope != nil {
+			line += fmt.Sprintf(" scope=/%d", *step.ECSScope)
+		}
+	}
+	if len(step.Answers) > 0 {
+		normalized := make([]string, 0, len(step.Answers))
+		for _, answer := range step.Answers {
+			normalized = append(normalized, normalizeSpace(answer))
+		}
+		line += " answers=" + strings.Join(normalized, " | ")
+	}
+	if step.Note != "" {
+		line += " note=" + step.Note
+	}
+	return stepStyle.Render(line)
+}
+
+// appendPaths renders an all-paths tree with each zone above the servers
+// that were asked about it.
+func appendPaths(lines []string, zone *model.PathZone, depth int, okStyle, failStyle lipgloss.Style) []string {
+	indent := strings.Repeat("  ", depth)
+	lines = append(lines, indent+zone.Zone)
+	for _, server := range zone.Servers {
+		serverDisplay := server.Server
+		if server.ServerName != "" {
+			serverDisplay = fmt.Sprintf("%s (%s)", server.Server, server.ServerName)
+		}
+		line := fmt.Sprintf("%s  %s %02d %s -> %s", indent, okStyle.Render("OK"), server.Step+1, serverDisplay, server.Outcome)
+		if server.Issue != "" {
+			line = fmt.Sprintf("%s  %s %02d %s -> %s (%s)", indent, failStyle.Render("DIFF"), server.Step+1, serverDisplay, server.Outcome, server.Issue)
+		}
+		lines = append(lines, line)
+		if server.Referral != nil {
+			lines = appendPaths(lines, server.Referral, depth+2, okStyle, failStyle)
+		}
+	}
+	return lines
+}
+
 func normalizeSpace(value string) string {
 	return strings.Join(strings.Fields(value), " ")
 }
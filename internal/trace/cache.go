@@ -0,0 +1,177 @@
+package trace
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+// cache keeps delegations and nameserver address answers, including negative
+// ones, for as long as their TTLs allow. Copies of a Tracer share it, except
+// the per-family passes of TraceDualStack. The main walk only fills it: every
+// trace still starts at the root so that each zone cut is seen, while
+// nameserver lookups start from the closest cached delegation.
+type cache struct {
+	mu          sync.Mutex
+	now         func() time.Time
+	delegations map[string]cachedDelegation
+	answers     map[cacheKey]cachedAnswer
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cachedDelegation struct {
+	zone    string
+	servers []string
+	labels  map[string]string
+	ns      []string
+	source  string
+	expires time.Time
+}
+
+type cachedAnswer struct {
+	resp    *dns.Msg
+	zone    string
+	source  string
+	expires time.Time
+}
+
+func newCache() *cache {
+	return &cache{now: time.Now, delegations: map[string]cachedDelegation{}, answers: map[cacheKey]cachedAnswer{}}
+}
+
+// storeDelegation caches the servers for zone from a referral until its NS
+// records expire.
+func (c *cache) storeDelegation(zone string, resp *dns.Msg, servers []string, labels map[string]string, source string) {
+	if c == nil || zone == "" || len(servers) == 0 {
+		return
+	}
+	ttl, ok := minTTL(resp.Ns)
+	if !ok || ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delegations[strings.ToLower(zone)] = cachedDelegation{
+		zone:    zone,
+		servers: servers,
+		labels:  labels,
+		ns:      nsStrings(resp.Ns),
+		source:  source,
+		expires: c.now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// delegation returns the closest cached delegation above name whose servers
+// survive filter.
+func (c *cache) delegation(name string, filter func([]string) []string) (cachedDelegation, bool) {
+	if c == nil {
+		return cachedDelegation{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for _, offset := range dns.Split(name) {
+		entry, ok := c.delegations[strings.ToLower(name[offset:])]
+		if !ok || now.After(entry.expires) {
+			continue
+		}
+		if servers := filter(entry.servers); len(servers) > 0 {
+			entry.servers = servers
+			return entry, true
+		}
+	}
+	return cachedDelegation{}, false
+}
+
+// storeAnswer caches an authoritative answer for name and qtype. Negative
+// answers are kept for the SOA negative TTL (RFC 2308 section 5) and are not
+// cached without an SOA.
+func (c *cache) storeAnswer(name string, qtype uint16, resp *dns.Msg, zone string, source string) {
+	if c == nil {
+		return
+	}
+	var ttl uint32
+	var ok bool
+	if len(resp.Answer) > 0 {
+		ttl, ok = minTTL(resp.Answer)
+	} else {
+		for _, rr := range resp.Ns {
+			if soa, isSOA := rr.(*dns.SOA); isSOA {
+				ttl, ok = soa.Hdr.Ttl, true
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+			}
+		}
+	}
+	if !ok || ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.answers[cacheKey{strings.ToLower(name), qtype}] = cachedAnswer{
+		resp:    resp,
+		zone:    zone,
+		source:  source,
+		expires: c.now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+func (c *cache) answer(name string, qtype uint16) (cachedAnswer, bool) {
+	if c == nil {
+		return cachedAnswer{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.answers[cacheKey{strings.ToLower(name), qtype}]
+	if !ok || c.now().After(entry.expires) {
+		return cachedAnswer{}, false
+	}
+	return entry, true
+}
+
+// cachedStep records a cache hit as a step so the trace shows where a lookup
+// was answered without a query.
+func cachedStep(result *model.TraceResult, name string, qtype uint16, zone string, source string, serverLabels map[string]string, resp *dns.Msg, ns []string, note string) {
+	step := model.TraceStep{
+		Index:      len(result.TraceSteps),
+		Server:     source,
+		ServerName: serverLabels[source],
+		Zone:       zone,
+		QueryName:  name,
+		QueryType:  dns.TypeToString[qtype],
+		Transport:  "cache",
+		RTT:        "0s",
+		Cached:     true,
+		Note:       appendNote("cached", note),
+		Timestamp:  time.Now(),
+		NS:         ns,
+	}
+	if resp != nil {
+		step.Rcode = dns.RcodeToString[resp.Rcode]
+		step.Authoritative = resp.Authoritative
+		step.Answers = rrStrings(resp.Answer)
+		step.SOA = soaString(resp)
+	}
+	result.TraceSteps = append(result.TraceSteps, step)
+	result.Timings = append(result.Timings, model.Timing{StepIndex: step.Index, Server: source, RTT: "0s", Transport: "cache"})
+}
+
+func minTTL(rrs []dns.RR) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rr := range rrs {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	return ttl, found
+}
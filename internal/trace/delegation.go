@@ -0,0 +1,276 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+// delegationChecks collects the zone cuts crossed during a walk so that each
+// parent referral can be compared with the child's own NS and address records
+// once the walk is done.
+type delegationChecks struct {
+	cuts []delegationCut
+}
+
+type delegationCut struct {
+	zone    string
+	ns      []string
+	glue    map[string][]string
+	servers []string
+	labels  map[string]string
+}
+
+type consistencyIssue struct {
+	kind analyze.OutcomeKind
+	text string
+	step int
+}
+
+// add records the referral for zone along with the servers the walk used to
+// reach the child.
+func (c *delegationChecks) add(zone string, resp *dns.Msg, servers []string, labels map[string]string) {
+	if c == nil || zone == "" {
+		return
+	}
+	for _, cut := range c.cuts {
+		if cut.zone == zone {
+			return
+		}
+	}
+	names, _ := nsNamesAndZone(resp)
+	for i := range names {
+		names[i] = strings.ToLower(names[i])
+	}
+	c.cuts = append(c.cuts, delegationCut{zone: zone, ns: uniqueStrings(names), glue: glueByName(resp), servers: servers, labels: labels})
+}
+
+// checkDelegations asks each child zone's servers for their NS RRset and for
+// the addresses of in-bailiwick nameservers, and compares them with what the
+// parent's referral carried.
+func (t *Tracer) checkDelegations(ctx context.Context, checks *delegationChecks, result *model.TraceResult) []consistencyIssue {
+	if checks == nil {
+		return nil
+	}
+	issues := []consistencyIssue{}
+	for _, cut := range checks.cuts {
+		issues = append(issues, t.checkDelegation(ctx, cut, result)...)
+	}
+	return issues
+}
+
+func (t *Tracer) checkDelegation(ctx context.Context, cut delegationCut, result *model.TraceResult) []consistencyIssue {
+	best, step := t.queryRecorded(ctx, cut.servers, cut.zone, dns.TypeNS, cut.zone, result, cut.labels)
+	noteStep(result, step, "delegation-check")
+	if best == nil || !best.resp.Authoritative || !hasAnswerType(best.resp, dns.TypeNS) {
+		return []consistencyIssue{{
+			kind: analyze.OutcomeNSMismatch,
+			text: fmt.Sprintf("%s: child servers did not return an authoritative NS RRset", cut.zone),
+			step: step,
+		}}
+	}
+	child := []string{}
+	for _, rr := range best.resp.Answer {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, cut.zone) {
+			child = append(child, strings.ToLower(dns.Fqdn(ns.Ns)))
+		}
+	}
+	child = uniqueStrings(child)
+
+	issues := []consistencyIssue{}
+	for _, name := range missingFrom(cut.ns, child) {
+		issues = append(issues, consistencyIssue{
+			kind: analyze.OutcomeNSMismatch,
+			text: fmt.Sprintf("%s: NS %s is in the parent delegation but not the child NS RRset", cut.zone, name),
+			step: step,
+		})
+	}
+	for _, name := range missingFrom(child, cut.ns) {
+		issues = append(issues, consistencyIssue{
+			kind: analyze.OutcomeNSMismatch,
+			text: fmt.Sprintf("%s: NS %s is in the child NS RRset but not the parent delegation", cut.zone, name),
+			step: step,
+		})
+	}
+
+	// Glue only matters for nameservers inside the child zone; resolvers
+	// look up the others from their own zones.
+	for _, name := range cut.ns {
+		if !dns.IsSubDomain(cut.zone, name) {
+			continue
+		}
+		for _, qtype := range t.addressTypes() {
+			glue := addressesOfType(cut.glue[name], qtype)
+			best, step := t.queryRecorded(ctx, cut.servers, name, qtype, cut.zone, result, cut.labels)
+			noteStep(result, step, "delegation-check")
+			records := []string{}
+			if best != nil && best.resp.Authoritative {
+				records = extractAddresses(best.resp, qtype)
+			}
+			sort.Strings(records)
+			typeName := dns.TypeToString[qtype]
+			switch {
+			case len(glue) == 0 && len(records) == 0:
+			case len(glue) == 0:
+				issues = append(issues, consistencyIssue{
+					kind: analyze.OutcomeGlueMismatch,
+					text: fmt.Sprintf("%s: no %s glue for %s; the child has %s", cut.zone, typeName, name, hostList(records)),
+					step: step,
+				})
+			case len(records) == 0:
+				issues = append(issues, consistencyIssue{
+					kind: analyze.OutcomeGlueMismatch,
+					text: fmt.Sprintf("%s: %s glue for %s (%s) has no %s record at the child", cut.zone, typeName, name, hostList(glue), typeName),
+					step: step,
+				})
+			case strings.Join(glue, ",") != strings.Join(records, ","):
+				issues = append(issues, consistencyIssue{
+					kind: analyze.OutcomeGlueMismatch,
+					text: fmt.Sprintf("%s: %s glue for %s is %s but the child has %s", cut.zone, typeName, name, hostList(glue), hostList(records)),
+					step: step,
+				})
+			}
+		}
+	}
+	return issues
+}
+
+// consistencySummaries orders the consistency findings by severity; the
+// first kind present names the diagnosis.
+var consistencySummaries = []struct {
+	kind    analyze.OutcomeKind
+	summary string
+}{
+	{analyze.OutcomeLameDelegation, "some nameservers are lame for the zone"},
+	{analyze.OutcomeNSMismatch, "parent and child NS sets differ"},
+	{analyze.OutcomeGlueMismatch, "parent glue differs from the child's address records"},
+	{analyze.OutcomeStaleSecondary, "some nameservers serve an older SOA serial"},
+	{analyze.OutcomeSOAMismatch, "nameservers disagree on the SOA"},
+	{analyze.OutcomeFragileDependencies, "nameserver dependencies are fragile"},
+}
+
+// consistencyDiagnosis reports consistency findings. They replace a result
+// that otherwise resolved, and are added as hints to one that failed.
+func consistencyDiagnosis(diagnosis model.Diagnosis, issues []consistencyIssue) model.Diagnosis {
+	if len(issues) == 0 {
+		return diagnosis
+	}
+	texts := make([]string, 0, len(issues))
+	steps := []int{}
+	kinds := map[analyze.OutcomeKind]bool{}
+	for _, issue := range issues {
+		texts = append(texts, issue.text)
+		steps = append(steps, issue.step)
+		kinds[issue.kind] = true
+	}
+	if !resolved(diagnosis) {
+		diagnosis.Hints = append(diagnosis.Hints, texts...)
+		return diagnosis
+	}
+	for _, entry := range consistencySummaries {
+		if !kinds[entry.kind] {
+			continue
+		}
+		result := analyze.Diagnose(analyze.Outcome{
+			Kind:          entry.kind,
+			Summary:       fmt.Sprintf("%s; best path: %s %s", entry.summary, diagnosis.Classification, diagnosis.Summary),
+			EvidenceStep:  -1,
+			EvidenceSteps: append(steps, diagnosis.EvidenceSteps...),
+			Records:       diagnosis.Records,
+			Hints:         append(texts, diagnosis.Hints...),
+		})
+		result.Warnings = diagnosis.Warnings
+		return result
+	}
+	return diagnosis
+}
+
+// resolved reports whether a diagnosis is a definite answer from the zone,
+// which consistency checks may override with a more specific finding.
+func resolved(diagnosis model.Diagnosis) bool {
+	switch analyze.OutcomeKind(diagnosis.Classification) {
+	case analyze.OutcomeSuccess, analyze.OutcomeNODATA, analyze.OutcomeNXDOMAIN, analyze.OutcomeDNSSECInsecure:
+		return true
+	}
+	return false
+}
+
+func (t *Tracer) addressTypes() []uint16 {
+	switch t.config.Family {
+	case FamilyIPv4:
+		return []uint16{dns.TypeA}
+	case FamilyIPv6:
+		return []uint16{dns.TypeAAAA}
+	}
+	return []uint16{dns.TypeA, dns.TypeAAAA}
+}
+
+// glueByName groups the glue in a referral by nameserver name.
+func glueByName(resp *dns.Msg) map[string][]string {
+	glue := map[string][]string{}
+	for _, rr := range resp.Extra {
+		name := strings.ToLower(rr.Header().Name)
+		switch record := rr.(type) {
+		case *dns.A:
+			glue[name] = append(glue[name], fmt.Sprintf("%s:53", record.A.String()))
+		case *dns.AAAA:
+			glue[name] = append(glue[name], fmt.Sprintf("[%s]:53", record.AAAA.String()))
+		}
+	}
+	return glue
+}
+
+func addressesOfType(addresses []string, qtype uint16) []string {
+	want := FamilyIPv4
+	if qtype == dns.TypeAAAA {
+		want = FamilyIPv6
+	}
+	out := []string{}
+	for _, address := range addresses {
+		if serverFamily(address) == want {
+			out = append(out, address)
+		}
+	}
+	out = uniqueStrings(out)
+	sort.Strings(out)
+	return out
+}
+
+// missingFrom returns the names in want that are not in have.
+func missingFrom(want, have []string) []string {
+	present := map[string]bool{}
+	for _, name := range have {
+		present[name] = true
+	}
+	missing := []string{}
+	for _, name := range want {
+		if !present[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func hostList(addresses []string) string {
+	hosts := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		hosts = append(hosts, address)
+	}
+	return strings.Join(hosts, " ")
+}
+
+func noteStep(result *model.TraceResult, step int, note string) {
+	if step >= 0 && step < len(result.TraceSteps) {
+		result.TraceSteps[step].Note = appendNote(result.TraceSteps[step].Note, note)
+	}
+}
@@ -0,0 +1,395 @@
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxNSEC3Iterations matches the limit validators enforce since RFC 9276.
+// Responses proven with more iterations are treated as insecure (section 3.2).
+const maxNSEC3Iterations = 150
+
+var errNSEC3Iterations = errors.New("NSEC3 iterations exceed the validator limit")
+
+// denialError reports a negative response whose NSEC or NSEC3 records do not
+// prove what the server claims. records holds the offending records.
+type denialError struct {
+	reason  string
+	records []string
+}
+
+func (e *denialError) Error() string {
+	return e.reason
+}
+
+func badDenial(records []dns.RR, format string, args ...any) *denialError {
+	return &denialError{reason: fmt.Sprintf(format, args...), records: rrStrings(records)}
+}
+
+type denialProof struct {
+	nsec     []*dns.NSEC
+	nsec3    []*dns.NSEC3
+	warnings []string
+}
+
+func collectDenial(section []dns.RR) *denialProof {
+	proof := &denialProof{}
+	for _, rr := range section {
+		switch record := rr.(type) {
+		case *dns.NSEC:
+			proof.nsec = append(proof.nsec, record)
+		case *dns.NSEC3:
+			proof.nsec3 = append(proof.nsec3, record)
+		}
+	}
+	return proof
+}
+
+// proveDenial checks that the NSEC or NSEC3 records in a negative response
+// prove the name or type does not exist (RFC 4035 section 5.4, RFC 5155
+// section 8). It returns warnings for weak but acceptable proofs.
+func proveDenial(resp *dns.Msg, qname string, qtype uint16) ([]string, error) {
+	proof := collectDenial(resp.Ns)
+	nameError := resp.Rcode == dns.RcodeNameError
+	var err error
+	switch {
+	case len(proof.nsec3) > 0:
+		err = proof.checkNSEC3Params()
+		if err == nil && nameError {
+			err = proof.nsec3NameError(qname)
+		} else if err == nil {
+			err = proof.nsec3NoData(qname, qtype)
+		}
+	case len(proof.nsec) > 0:
+		if nameError {
+			err = proof.nsecNameError(qname)
+		} else {
+			err = proof.nsecNoData(qname, qtype)
+		}
+	default:
+		err = badDenial(nil, "negative response for %s has no NSEC or NSEC3 records", qname)
+	}
+	return proof.warnings, err
+}
+
+// proveWildcardAnswer checks that an answer synthesized from a wildcard comes
+// with proof that the query name itself does not exist. A query for the
+// wildcard name itself is answered from it directly and needs no proof.
+func proveWildcardAnswer(resp *dns.Msg, keys map[string][]*dns.DNSKEY, now time.Time) ([]string, error) {
+	for _, rr := range resp.Answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		owner := dns.Fqdn(sig.Hdr.Name)
+		labels := dns.Split(owner)
+		if int(sig.Labels) >= len(labels) {
+			continue
+		}
+		if int(sig.Labels) == len(labels)-1 && strings.HasPrefix(owner, "*.") {
+			continue
+		}
+		if err := verifySection(denialRecords(resp.Ns), keys, now); err != nil {
+			return nil, err
+		}
+		proof := collectDenial(resp.Ns)
+		nextCloser := owner[labels[len(labels)-int(sig.Labels)-1]:]
+		switch {
+		case len(proof.nsec3) > 0:
+			if err := proof.checkNSEC3Params(); err != nil {
+				return proof.warnings, err
+			}
+			if proof.nsec3Covering(nextCloser) == nil {
+				return proof.warnings, badDenial(rrsFromNSEC3(proof.nsec3), "wildcard answer for %s without NSEC3 covering %s", owner, nextCloser)
+			}
+		case len(proof.nsec) > 0:
+			if proof.nsecCovering(owner) == nil {
+				return nil, badDenial(rrsFromNSEC(proof.nsec), "wildcard answer for %s without NSEC covering it", owner)
+			}
+		default:
+			return nil, badDenial(nil, "wildcard answer for %s without NSEC or NSEC3 proof", owner)
+		}
+		return proof.warnings, nil
+	}
+	return nil, nil
+}
+
+func (p *denialProof) nsecNameError(qname string) error {
+	cover := p.nsecCovering(qname)
+	if cover == nil {
+		return badDenial(rrsFromNSEC(p.nsec), "no NSEC covers %s", qname)
+	}
+	wildcard := wildcardName(nsecClosestEncloser(qname, cover))
+	if p.nsecCovering(wildcard) == nil {
+		return badDenial(rrsFromNSEC(p.nsec), "no NSEC proves wildcard %s does not exist", wildcard)
+	}
+	return nil
+}
+
+func (p *denialProof) nsecNoData(qname string, qtype uint16) error {
+	if match := p.nsecMatching(qname); match != nil {
+		return bitmapDenies(match, match.TypeBitMap, qname, qtype)
+	}
+	cover := p.nsecCovering(qname)
+	if cover == nil {
+		return badDenial(rrsFromNSEC(p.nsec), "no NSEC matches or covers %s", qname)
+	}
+	// An empty non-terminal has no NSEC of its own; the covering NSEC's next
+	// name sits below it.
+	if dns.IsSubDomain(qname, cover.NextDomain) {
+		return nil
+	}
+	wildcard := wildcardName(nsecClosestEncloser(qname, cover))
+	match := p.nsecMatching(wildcard)
+	if match == nil {
+		return badDenial(rrsFromNSEC(p.nsec), "no NSEC matches %s or wildcard %s", qname, wildcard)
+	}
+	return bitmapDenies(match, match.TypeBitMap, wildcard, qtype)
+}
+
+func (p *denialProof) nsecMatching(name string) *dns.NSEC {
+	for _, nsec := range p.nsec {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+func (p *denialProof) nsecCovering(name string) *dns.NSEC {
+	for _, nsec := range p.nsec {
+		if nsecCovers(nsec, name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := nsec.Hdr.Name
+	// Names below a delegation or DNAME are not proven by the parent's NSEC
+	// (RFC 6840 section 4.1).
+	if dns.IsSubDomain(owner, name) && !strings.EqualFold(owner, name) {
+		if typeInBitmap(nsec.TypeBitMap, dns.TypeDNAME) || (typeInBitmap(nsec.TypeBitMap, dns.TypeNS) && !typeInBitmap(nsec.TypeBitMap, dns.TypeSOA)) {
+			return false
+		}
+	}
+	afterOwner := canonicalCompare(owner, name) < 0
+	beforeNext := canonicalCompare(name, nsec.NextDomain) < 0
+	if canonicalCompare(owner, nsec.NextDomain) >= 0 {
+		// The last NSEC in the zone wraps around to the apex.
+		return afterOwner || beforeNext
+	}
+	return afterOwner && beforeNext
+}
+
+func nsecClosestEncloser(qname string, nsec *dns.NSEC) string {
+	common := dns.CompareDomainName(qname, nsec.Hdr.Name)
+	if next := dns.CompareDomainName(qname, nsec.NextDomain); next > common {
+		common = next
+	}
+	return ancestor(qname, common)
+}
+
+func (p *denialProof) checkNSEC3Params() error {
+	first := p.nsec3[0]
+	for _, nsec3 := range p.nsec3[1:] {
+		if nsec3.Hash != first.Hash || nsec3.Iterations != first.Iterations || !strings.EqualFold(nsec3.Salt, first.Salt) {
+			return badDenial(rrsFromNSEC3(p.nsec3), "NSEC3 records disagree on hash parameters")
+		}
+	}
+	if first.Hash != dns.SHA1 {
+		return badDenial(rrsFromNSEC3(p.nsec3), "unknown NSEC3 hash algorithm %d", first.Hash)
+	}
+	if first.Iterations > 0 {
+		p.warnings = append(p.warnings, fmt.Sprintf("NSEC3 uses %d iterations; RFC 9276 recommends 0", first.Iterations))
+	}
+	if first.Iterations > maxNSEC3Iterations {
+		return fmt.Errorf("%w of %d: %d", errNSEC3Iterations, maxNSEC3Iterations, first.Iterations)
+	}
+	if first.Salt != "" && first.Salt != "-" {
+		p.warnings = append(p.warnings, "NSEC3 uses a salt; RFC 9276 recommends none")
+	}
+	return nil
+}
+
+func (p *denialProof) nsec3NameError(qname string) error {
+	encloser, nextCloser, _, err := p.closestEncloser(qname)
+	if err != nil {
+		return err
+	}
+	if nextCloser == "" {
+		return badDenial(rrsFromNSEC3(p.nsec3), "NXDOMAIN for %s but an NSEC3 matches it", qname)
+	}
+	wildcard := wildcardName(encloser)
+	if p.nsec3Covering(wildcard) == nil {
+		return badDenial(rrsFromNSEC3(p.nsec3), "no NSEC3 proves wildcard %s does not exist", wildcard)
+	}
+	return nil
+}
+
+func (p *denialProof) nsec3NoData(qname string, qtype uint16) error {
+	if match := p.nsec3Matching(qname); match != nil {
+		return bitmapDenies(match, match.TypeBitMap, qname, qtype)
+	}
+	encloser, _, cover, err := p.closestEncloser(qname)
+	if err != nil {
+		return err
+	}
+	if qtype == dns.TypeDS {
+		// An unsigned delegation inside an opt-out span has no NSEC3 of its
+		// own (RFC 5155 section 8.6).
+		if cover.Flags&1 == 1 {
+			p.warnings = append(p.warnings, fmt.Sprintf("no DS for %s proven by opt-out NSEC3", qname))
+			return nil
+		}
+		return badDenial([]dns.RR{cover}, "no NSEC3 matches %s and the covering NSEC3 is not opt-out", qname)
+	}
+	wildcard := wildcardName(encloser)
+	match := p.nsec3Matching(wildcard)
+	if match == nil {
+		return badDenial(rrsFromNSEC3(p.nsec3), "no NSEC3 matches %s or wildcard %s", qname, wildcard)
+	}
+	return bitmapDenies(match, match.TypeBitMap, wildcard, qtype)
+}
+
+// closestEncloser finds the closest provable ancestor of qname and the NSEC3
+// covering the next closer name (RFC 5155 section 8.3). nextCloser is empty
+// when qname itself matches.
+func (p *denialProof) closestEncloser(qname string) (string, string, *dns.NSEC3, error) {
+	labels := dns.Split(qname)
+	for i := range labels {
+		candidate := qname[labels[i]:]
+		match := p.nsec3Matching(candidate)
+		if match == nil {
+			continue
+		}
+		if i == 0 {
+			return candidate, "", nil, nil
+		}
+		if typeInBitmap(match.TypeBitMap, dns.TypeDNAME) || (typeInBitmap(match.TypeBitMap, dns.TypeNS) && !typeInBitmap(match.TypeBitMap, dns.TypeSOA)) {
+			return "", "", nil, badDenial([]dns.RR{match}, "closest encloser %s is a delegation or DNAME", candidate)
+		}
+		nextCloser := qname[labels[i-1]:]
+		cover := p.nsec3Covering(nextCloser)
+		if cover == nil {
+			return "", "", nil, badDenial(rrsFromNSEC3(p.nsec3), "closest encloser %s found but no NSEC3 covers next closer %s", candidate, nextCloser)
+		}
+		if cover.Flags&1 == 1 {
+			p.warnings = append(p.warnings, fmt.Sprintf("next closer %s is covered by an opt-out NSEC3", nextCloser))
+		}
+		return candidate, nextCloser, cover, nil
+	}
+	return "", "", nil, badDenial(rrsFromNSEC3(p.nsec3), "no NSEC3 matches an ancestor of %s", qname)
+}
+
+func (p *denialProof) nsec3Matching(name string) *dns.NSEC3 {
+	for _, nsec3 := range p.nsec3 {
+		if nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+func (p *denialProof) nsec3Covering(name string) *dns.NSEC3 {
+	for _, nsec3 := range p.nsec3 {
+		if nsec3.Cover(name) && !nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+func bitmapDenies(rr dns.RR, bitmap []uint16, name string, qtype uint16) error {
+	if typeInBitmap(bitmap, qtype) {
+		return badDenial([]dns.RR{rr}, "NODATA for %s %s but the denial record lists that type", name, dns.TypeToString[qtype])
+	}
+	if qtype != dns.TypeDS && typeInBitmap(bitmap, dns.TypeCNAME) {
+		return badDenial([]dns.RR{rr}, "NODATA for %s %s but the denial record lists CNAME", name, dns.TypeToString[qtype])
+	}
+	return nil
+}
+
+func typeInBitmap(bitmap []uint16, qtype uint16) bool {
+	for _, t := range bitmap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+func denialRecords(section []dns.RR) []dns.RR {
+	out := []dns.RR{}
+	for _, rr := range section {
+		switch record := rr.(type) {
+		case *dns.NSEC, *dns.NSEC3:
+			out = append(out, rr)
+		case *dns.RRSIG:
+			if record.TypeCovered == dns.TypeNSEC || record.TypeCovered == dns.TypeNSEC3 {
+				out = append(out, rr)
+			}
+		}
+	}
+	return out
+}
+
+func rrsFromNSEC(records []*dns.NSEC) []dns.RR {
+	out := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		out = append(out, rr)
+	}
+	return out
+}
+
+func rrsFromNSEC3(records []*dns.NSEC3) []dns.RR {
+	out := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		out = append(out, rr)
+	}
+	return out
+}
+
+func wildcardName(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+// ancestor returns the last n labels of name.
+func ancestor(name string, n int) string {
+	labels := dns.Split(name)
+	if n <= 0 || len(labels) == 0 {
+		return "."
+	}
+	if n >= len(labels) {
+		return name
+	}
+	return name[labels[len(labels)-n]:]
+}
+
+// canonicalCompare orders names as RFC 4034 section 6.1 does: label by label
+// from the right, case-insensitively.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	default:
+		return 0
+	}
+}
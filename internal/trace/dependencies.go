@@ -0,0 +1,287 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// maxDependencyZones bounds how many zones the dependency check follows.
+const maxDependencyZones = 32
+
+// maxNameserverLookups bounds the nameserver address lookups of one trace, so
+// long chains of glue-less delegations end even without a cycle.
+const maxNameserverLookups = 64
+
+// dependencies records the NS names of every delegation seen and the deepest
+// zone known to hold each nameserver name. Each trace starts with its own. It
+// is filled whether or not a lookup succeeds, so loops that cycle detection
+// cuts short still show up in the graph. resolving holds the zones whose
+// nameserver addresses are being looked up, outermost first.
+type dependencies struct {
+	mu        sync.Mutex
+	zones     map[string][]string
+	hosts     map[string]string
+	resolving []string
+	lookups   int
+}
+
+func newDependencies() *dependencies {
+	return &dependencies{zones: map[string][]string{}, hosts: map[string]string{}}
+}
+
+// referral records the NS names a parent delegated zone to.
+func (d *dependencies) referral(zone string, names []string) {
+	if d == nil || zone == "" || len(names) == 0 {
+		return
+	}
+	lower := make([]string, 0, len(names))
+	for _, name := range names {
+		lower = append(lower, strings.ToLower(dns.Fqdn(name)))
+	}
+	lower = uniqueStrings(lower)
+	sort.Strings(lower)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.zones[strings.ToLower(zone)] = lower
+}
+
+// host records that name sits in zone or below it.
+func (d *dependencies) host(name string, zone string) {
+	if d == nil || zone == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hosts[strings.ToLower(dns.Fqdn(name))] = strings.ToLower(zone)
+}
+
+// enter marks the nameservers of zone as being resolved. It fails when they
+// already are, since the lookup then depends on itself.
+func (d *dependencies) enter(zone string) error {
+	if d == nil {
+		return nil
+	}
+	zone = strings.ToLower(dns.Fqdn(zone))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, resolving := range d.resolving {
+		if resolving == zone {
+			cycle := append(append([]string{}, d.resolving[i:]...), zone)
+			return fmt.Errorf("nameserver dependency cycle %s", strings.Join(cycle, " -> "))
+		}
+	}
+	d.resolving = append(d.resolving, zone)
+	return nil
+}
+
+func (d *dependencies) leave() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resolving = d.resolving[:len(d.resolving)-1]
+}
+
+// spend counts one nameserver address lookup against the trace's budget.
+func (d *dependencies) spend() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lookups >= maxNameserverLookups {
+		return fmt.Errorf("nameserver lookup budget of %d exhausted", maxNameserverLookups)
+	}
+	d.lookups++
+	return nil
+}
+
+func (d *dependencies) nameservers(zone string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.zones[zone]
+}
+
+func (d *dependencies) zoneOf(name string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	zone, ok := d.hosts[name]
+	return zone, ok
+}
+
+// closest returns the deepest delegated zone at or above name.
+func (d *dependencies) closest(name string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, offset := range dns.Split(name) {
+		if _, ok := d.zones[name[offset:]]; ok {
+			return name[offset:], true
+		}
+	}
+	return "", false
+}
+
+// checkDependencies follows the zones that hold the nameservers of name's
+// zone, and of those zones in turn, and reports dependency cycles and zones
+// in the chain whose nameservers all sit with one provider or under one TLD.
+func (t *Tracer) checkDependencies(ctx context.Context, name string, result *model.TraceResult) []consistencyIssue {
+	start, ok := t.deps.closest(name)
+	if !ok {
+		return nil
+	}
+	graph := map[string][]string{}
+	order := []string{start}
+	seen := map[string]bool{start: true}
+	for i := 0; i < len(order) && i < maxDependencyZones; i++ {
+		zone := order[i]
+		for _, ns := range t.deps.nameservers(zone) {
+			provider, ok := t.nameserverZone(ctx, zone, ns, result)
+			if !ok {
+				continue
+			}
+			if provider != zone && !containsZone(graph[zone], provider) {
+				graph[zone] = append(graph[zone], provider)
+			}
+			if !seen[provider] {
+				seen[provider] = true
+				order = append(order, provider)
+			}
+		}
+	}
+
+	issues := []consistencyIssue{}
+	for _, cycle := range dependencyCycles(graph, start) {
+		issues = append(issues, consistencyIssue{
+			kind: analyze.OutcomeFragileDependencies,
+			text: fmt.Sprintf("nameserver dependency cycle %s: each zone needs the next to resolve its nameservers", strings.Join(cycle, " -> ")),
+			step: -1,
+		})
+	}
+	for _, zone := range order {
+		if text := concentration(zone, t.deps.nameservers(zone)); text != "" {
+			issues = append(issues, consistencyIssue{kind: analyze.OutcomeFragileDependencies, text: text, step: -1})
+		}
+	}
+	return issues
+}
+
+// nameserverZone finds the zone that holds ns, looking it up when no earlier
+// lookup reached it. In-bailiwick names are taken to sit in zone unless a
+// deeper zone is already known.
+func (t *Tracer) nameserverZone(ctx context.Context, zone string, ns string, result *model.TraceResult) (string, bool) {
+	known, ok := t.deps.zoneOf(ns)
+	if dns.IsSubDomain(zone, ns) {
+		if ok && dns.IsSubDomain(zone, known) {
+			return known, true
+		}
+		return zone, true
+	}
+	if ok {
+		return known, true
+	}
+	t.subTrace(ctx, ns, t.addressTypes()[0], result)
+	return t.deps.zoneOf(ns)
+}
+
+// dependencyCycles returns each cycle reachable from start once, as the
+// zones in order with the first repeated at the end.
+func dependencyCycles(graph map[string][]string, start string) [][]string {
+	cycles := [][]string{}
+	found := map[string]bool{}
+	onStack := map[string]bool{}
+	done := map[string]bool{}
+	stack := []string{}
+	var visit func(zone string)
+	visit = func(zone string) {
+		onStack[zone] = true
+		stack = append(stack, zone)
+		for _, next := range graph[zone] {
+			if onStack[next] {
+				for i := range stack {
+					if stack[i] != next {
+						continue
+					}
+					cycle := append(append([]string{}, stack[i:]...), next)
+					key := cycleKey(stack[i:])
+					if !found[key] {
+						found[key] = true
+						cycles = append(cycles, cycle)
+					}
+					break
+				}
+				continue
+			}
+			if !done[next] {
+				visit(next)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		onStack[zone] = false
+		done[zone] = true
+	}
+	visit(start)
+	return cycles
+}
+
+// cycleKey names a cycle independently of the zone it was entered from.
+func cycleKey(zones []string) string {
+	sorted := append([]string{}, zones...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+// concentration describes a zone below the TLDs whose nameservers all sit
+// under one registrable domain, taken as one provider, or under one TLD.
+func concentration(zone string, nameservers []string) string {
+	if dns.CountLabel(zone) < 2 {
+		return ""
+	}
+	domains := map[string]bool{}
+	tlds := map[string]bool{}
+	for _, ns := range nameservers {
+		labels := dns.SplitDomainName(ns)
+		if len(labels) == 0 {
+			continue
+		}
+		host := strings.Join(labels, ".")
+		domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+		if err != nil {
+			domain = host
+		}
+		domains[dns.Fqdn(domain)] = true
+		tlds[labels[len(labels)-1]] = true
+	}
+	if len(domains) == 1 {
+		for domain := range domains {
+			return fmt.Sprintf("%s: every nameserver is under %s, a single provider", zone, domain)
+		}
+	}
+	if len(tlds) == 1 {
+		for tld := range tlds {
+			return fmt.Sprintf("%s: every nameserver is under the .%s TLD", zone, tld)
+		}
+	}
+	return ""
+}
+
+func containsZone(zones []string, zone string) bool {
+	for _, z := range zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
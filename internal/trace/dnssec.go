@@ -0,0 +1,529 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+type chainStatus string
+
+const (
+	chainSecure        chainStatus = "secure"
+	chainInsecure      chainStatus = "insecure"
+	chainBogus         chainStatus = "bogus"
+	chainIndeterminate chainStatus = "indeterminate"
+)
+
+var errUnknownSigner = errors.New("no validated DNSKEY for signer")
+
+var supportedAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+var supportedDigests = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+// dnssecChain tracks the chain of trust while the trace walks down from the
+// root. The first zone that is not secure decides the status for everything
+// below it.
+type dnssecChain struct {
+	status   chainStatus
+	zone     string
+	reason   string
+	keys     map[string][]*dns.DNSKEY
+	evidence []int
+	now      time.Time
+	// denial is set when the failure is a broken NSEC/NSEC3 proof; records
+	// holds the offending records.
+	denial   bool
+	records  []string
+	warnings []string
+	cuts     []*zoneCut
+}
+
+// zoneCut keeps the DS, DNSKEY and RRSIG records seen for one zone so the
+// health report can describe them.
+type zoneCut struct {
+	zone   string
+	status chainStatus
+	ds     []*dns.DS
+	keys   []*dns.DNSKEY
+	sigs   []*dns.RRSIG
+	steps  []int
+}
+
+func (c *dnssecChain) cut(zone string) *zoneCut {
+	for _, cut := range c.cuts {
+		if strings.EqualFold(cut.zone, zone) {
+			return cut
+		}
+	}
+	cut := &zoneCut{zone: zone}
+	c.cuts = append(c.cuts, cut)
+	return cut
+}
+
+// clone returns a copy of the chain that can be extended without changing c.
+// The records themselves are shared; only the slices and maps are copied.
+func (c *dnssecChain) clone() *dnssecChain {
+	copied := *c
+	copied.keys = make(map[string][]*dns.DNSKEY, len(c.keys))
+	for zone, keys := range c.keys {
+		copied.keys[zone] = append([]*dns.DNSKEY(nil), keys...)
+	}
+	copied.evidence = append([]int(nil), c.evidence...)
+	copied.records = append([]string(nil), c.records...)
+	copied.warnings = append([]string(nil), c.warnings...)
+	copied.cuts = make([]*zoneCut, 0, len(c.cuts))
+	for _, cut := range c.cuts {
+		cutCopy := *cut
+		cutCopy.ds = append([]*dns.DS(nil), cut.ds...)
+		cutCopy.keys = append([]*dns.DNSKEY(nil), cut.keys...)
+		cutCopy.sigs = append([]*dns.RRSIG(nil), cut.sigs...)
+		cutCopy.steps = append([]int(nil), cut.steps...)
+		copied.cuts = append(copied.cuts, &cutCopy)
+	}
+	return &copied
+}
+
+// observe files every RRSIG in section under the zone that made it.
+func (c *dnssecChain) observe(section []dns.RR) {
+	for _, rr := range section {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		for _, cut := range c.cuts {
+			if strings.EqualFold(cut.zone, sig.SignerName) {
+				cut.sigs = append(cut.sigs, sig)
+			}
+		}
+	}
+}
+
+func (c *dnssecChain) fail(status chainStatus, zone string, reason string, steps ...int) {
+	if c.status != chainSecure {
+		return
+	}
+	c.status = status
+	c.zone = zone
+	c.reason = reason
+	for _, step := range steps {
+		if step >= 0 {
+			c.evidence = append(c.evidence, step)
+		}
+	}
+}
+
+func (c *dnssecChain) failErr(zone string, err error, step int) {
+	if c.status != chainSecure {
+		return
+	}
+	c.fail(failureStatus(err), zone, err.Error(), step)
+	var denial *denialError
+	if errors.As(err, &denial) {
+		c.denial = true
+		c.records = denial.records
+	}
+}
+
+func (t *Tracer) startChain(ctx context.Context, servers []string, result *model.TraceResult, serverLabels map[string]string) *dnssecChain {
+	chain := &dnssecChain{status: chainSecure, zone: ".", keys: map[string][]*dns.DNSKEY{}, now: time.Now()}
+	t.loadKeys(ctx, chain, ".", t.trustAnchors, servers, result, serverLabels)
+	return chain
+}
+
+// extendChain follows a referral from parent to child: the DS RRset must be
+// signed by the parent and must match a DNSKEY that signs the child's keys.
+func (t *Tracer) extendChain(ctx context.Context, chain *dnssecChain, parent string, parentServers []string, parentLabels map[string]string, child string, childServers []string, childLabels map[string]string, result *model.TraceResult) {
+	if chain.status != chainSecure || child == "" || strings.EqualFold(parent, child) || !dns.IsSubDomain(parent, child) {
+		return
+	}
+	best, step := t.queryRecorded(ctx, parentServers, child, dns.TypeDS, parent, result, parentLabels)
+	cut := chain.cut(child)
+	cut.steps = append(cut.steps, step)
+	defer func() {
+		if cut.status == "" {
+			cut.status = chain.status
+		}
+	}()
+	if best == nil {
+		chain.fail(chainIndeterminate, child, fmt.Sprintf("no response to DS query for %s", child), step)
+		markStep(result, step, chain.status)
+		return
+	}
+	resp := best.resp
+	chain.observe(resp.Answer)
+	chain.observe(resp.Ns)
+	rrset, sigs := rrsetFromSection(resp.Answer, child, dns.TypeDS)
+	for _, rr := range rrset {
+		cut.ds = append(cut.ds, rr.(*dns.DS))
+	}
+	if len(rrset) == 0 {
+		warnings, err := verifyNoDS(resp, child, chain.keys, chain.now)
+		chain.warnings = append(chain.warnings, warnings...)
+		if err != nil {
+			chain.failErr(child, fmt.Errorf("absence of DS for %s not proven: %w", child, err), step)
+		} else {
+			chain.fail(chainInsecure, child, fmt.Sprintf("no DS for %s in %s", child, parent), step)
+		}
+		markStep(result, step, chain.status)
+		return
+	}
+	if err := verifyRRset(rrset, sigs, chain.keys, chain.now); err != nil {
+		chain.fail(failureStatus(err), child, fmt.Sprintf("DS for %s: %v", child, err), step)
+		markStep(result, step, chain.status)
+		return
+	}
+	ds := []*dns.DS{}
+	for _, rr := range rrset {
+		record := rr.(*dns.DS)
+		if supportedAlgorithms[record.Algorithm] && supportedDigests[record.DigestType] {
+			ds = append(ds, record)
+		}
+	}
+	if len(ds) == 0 {
+		chain.fail(chainInsecure, child, fmt.Sprintf("DS for %s only uses unsupported algorithms", child), step)
+		markStep(result, step, chain.status)
+		return
+	}
+	markStep(result, step, chainSecure)
+	t.loadKeys(ctx, chain, child, ds, childServers, result, childLabels)
+}
+
+func (t *Tracer) loadKeys(ctx context.Context, chain *dnssecChain, zone string, ds []*dns.DS, servers []string, result *model.TraceResult, serverLabels map[string]string) {
+	best, step := t.queryRecorded(ctx, servers, zone, dns.TypeDNSKEY, zone, result, serverLabels)
+	cut := chain.cut(zone)
+	cut.steps = append(cut.steps, step)
+	if len(cut.ds) == 0 {
+		cut.ds = ds
+	}
+	defer func() { cut.status = chain.status }()
+	if best == nil {
+		chain.fail(chainIndeterminate, zone, fmt.Sprintf("no response to DNSKEY query for %s", zone), step)
+		markStep(result, step, chain.status)
+		return
+	}
+	rrset, _ := rrsetFromSection(best.resp.Answer, zone, dns.TypeDNSKEY)
+	for _, rr := range rrset {
+		cut.keys = append(cut.keys, rr.(*dns.DNSKEY))
+	}
+	chain.observe(best.resp.Answer)
+	keys, err := verifyDNSKEYs(best.resp, zone, ds, chain.now)
+	if err != nil {
+		chain.fail(chainBogus, zone, err.Error(), step)
+		markStep(result, step, chain.status)
+		return
+	}
+	chain.keys[strings.ToLower(zone)] = keys
+	markStep(result, step, chainSecure)
+}
+
+// checkResponse validates the signatures on an answer or negative response
+// from a zone the chain has reached.
+func (t *Tracer) checkResponse(chain *dnssecChain, resp *dns.Msg, zone string, step int, result *model.TraceResult) {
+	if chain == nil {
+		return
+	}
+	chain.observe(resp.Answer)
+	chain.observe(resp.Ns)
+	if chain.status == chainSecure {
+		var warnings []string
+		var err error
+		if len(resp.Answer) > 0 {
+			err = verifySection(resp.Answer, chain.keys, chain.now)
+			if err == nil {
+				warnings, err = proveWildcardAnswer(resp, chain.keys, chain.now)
+			}
+		} else {
+			err = verifyDenial(resp, chain.keys, chain.now)
+			if err == nil && len(resp.Question) > 0 {
+				warnings, err = proveDenial(resp, resp.Question[0].Name, resp.Question[0].Qtype)
+			}
+		}
+		chain.warnings = append(chain.warnings, warnings...)
+		if err != nil {
+			chain.failErr(zone, err, step)
+		}
+	}
+	markStep(result, step, chain.status)
+}
+
+// dnssecOutcome folds the chain status into a resolution outcome. A bogus
+// chain fails the lookup the way a validating resolver would.
+func dnssecOutcome(chain *dnssecChain, outcome analyze.Outcome) analyze.Outcome {
+	if chain == nil {
+		return outcome
+	}
+	outcome = dnssecStatusOutcome(chain, outcome)
+	outcome.Hints = append(outcome.Hints, uniqueStrings(chain.warnings)...)
+	return outcome
+}
+
+func dnssecStatusOutcome(chain *dnssecChain, outcome analyze.Outcome) analyze.Outcome {
+	switch chain.status {
+	case chainBogus:
+		if chain.denial {
+			return analyze.Outcome{
+				Kind:          analyze.OutcomeDNSSECBadDenial,
+				Summary:       fmt.Sprintf("denial of existence in %s is not proven: %s", chain.zone, chain.reason),
+				EvidenceStep:  outcome.EvidenceStep,
+				EvidenceSteps: chain.evidence,
+				Records:       chain.records,
+				Hints:         []string{fmt.Sprintf("re-sign %s and check its NSEC3PARAM against the served NSEC3 chain", chain.zone)},
+			}
+		}
+		return analyze.Outcome{
+			Kind:          analyze.OutcomeDNSSECBogus,
+			Summary:       fmt.Sprintf("DNSSEC validation failed at %s: %s", chain.zone, chain.reason),
+			EvidenceStep:  outcome.EvidenceStep,
+			EvidenceSteps: chain.evidence,
+			Hints: []string{
+				fmt.Sprintf("check that the DS records for %s match a published DNSKEY", chain.zone),
+				"check RRSIG validity windows and re-sign the zone if signatures expired",
+			},
+		}
+	case chainIndeterminate:
+		if outcome.Kind != analyze.OutcomeSuccess {
+			outcome.Hints = append(outcome.Hints, fmt.Sprintf("DNSSEC status unknown at %s: %s", chain.zone, chain.reason))
+			return outcome
+		}
+		return analyze.Outcome{
+			Kind:          analyze.OutcomeDNSSECIndeterminate,
+			Summary:       fmt.Sprintf("answer returned but the chain of trust could not be checked at %s: %s", chain.zone, chain.reason),
+			EvidenceStep:  outcome.EvidenceStep,
+			EvidenceSteps: chain.evidence,
+			Hints:         []string{"retry with --transport tcp", "verify DS and DNSKEY queries reach the nameservers"},
+		}
+	case chainInsecure:
+		if outcome.Kind != analyze.OutcomeSuccess {
+			outcome.Hints = append(outcome.Hints, fmt.Sprintf("DNSSEC insecure below %s: %s", chain.zone, chain.reason))
+			return outcome
+		}
+		return analyze.Outcome{
+			Kind:          analyze.OutcomeDNSSECInsecure,
+			Summary:       fmt.Sprintf("authoritative answer returned from unsigned delegation: %s", chain.reason),
+			EvidenceStep:  outcome.EvidenceStep,
+			EvidenceSteps: chain.evidence,
+			Hints:         []string{fmt.Sprintf("sign %s and publish its DS record in the parent zone", chain.zone)},
+		}
+	default:
+		outcome.Summary += " (DNSSEC secure)"
+		return outcome
+	}
+}
+
+func failureStatus(err error) chainStatus {
+	if errors.Is(err, errUnknownSigner) {
+		return chainIndeterminate
+	}
+	if errors.Is(err, errNSEC3Iterations) {
+		return chainInsecure
+	}
+	return chainBogus
+}
+
+func markStep(result *model.TraceResult, step int, status chainStatus) {
+	if step >= 0 && step < len(result.TraceSteps) {
+		result.TraceSteps[step].DNSSEC = string(status)
+	}
+}
+
+// verifyDNSKEYs returns the zone's keys once a key matching one of the DS
+// records has signed the DNSKEY RRset.
+func verifyDNSKEYs(resp *dns.Msg, zone string, ds []*dns.DS, now time.Time) ([]*dns.DNSKEY, error) {
+	rrset, sigs := rrsetFromSection(resp.Answer, zone, dns.TypeDNSKEY)
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("no DNSKEY records for %s", zone)
+	}
+	keys := make([]*dns.DNSKEY, 0, len(rrset))
+	for _, rr := range rrset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	var lastErr error
+	for _, anchor := range ds {
+		for _, key := range keys {
+			if key.KeyTag() != anchor.KeyTag || key.Algorithm != anchor.Algorithm {
+				continue
+			}
+			digest := key.ToDS(anchor.DigestType)
+			if digest == nil || !strings.EqualFold(digest.Digest, anchor.Digest) {
+				continue
+			}
+			err := verifyWithKey(rrset, sigs, key, now)
+			if err == nil {
+				return keys, nil
+			}
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	tags := []string{}
+	for _, anchor := range ds {
+		tags = append(tags, fmt.Sprintf("%d", anchor.KeyTag))
+	}
+	return nil, fmt.Errorf("no DNSKEY for %s matches DS key tags %s", zone, strings.Join(tags, ","))
+}
+
+func verifyWithKey(rrset []dns.RR, sigs []*dns.RRSIG, key *dns.DNSKEY, now time.Time) error {
+	header := rrset[0].Header()
+	for _, sig := range sigs {
+		if sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			return signatureWindowError(header, sig)
+		}
+		if err := sig.Verify(key, rrset); err != nil {
+			return fmt.Errorf("RRSIG on %s %s by key %d does not verify: %v", header.Name, dns.TypeToString[header.Rrtype], sig.KeyTag, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s %s is not signed by key %d", header.Name, dns.TypeToString[header.Rrtype], key.KeyTag())
+}
+
+// verifyRRset checks that at least one RRSIG over rrset verifies with a key
+// the chain has already validated.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys map[string][]*dns.DNSKEY, now time.Time) error {
+	header := rrset[0].Header()
+	if len(sigs) == 0 {
+		return fmt.Errorf("%s %s has no RRSIG", header.Name, dns.TypeToString[header.Rrtype])
+	}
+	var lastErr error
+	for _, sig := range sigs {
+		zoneKeys, ok := keys[strings.ToLower(dns.Fqdn(sig.SignerName))]
+		if !ok {
+			lastErr = fmt.Errorf("%w %s on %s %s", errUnknownSigner, sig.SignerName, header.Name, dns.TypeToString[header.Rrtype])
+			continue
+		}
+		for _, key := range zoneKeys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			err := verifyWithKey(rrset, []*dns.RRSIG{sig}, key, now)
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("RRSIG on %s %s references missing DNSKEY %d", header.Name, dns.TypeToString[header.Rrtype], sig.KeyTag)
+		}
+	}
+	return lastErr
+}
+
+// verifySection verifies every RRset in a response section. CNAMEs
+// synthesized from a DNAME are unsigned and skipped.
+func verifySection(section []dns.RR, keys map[string][]*dns.DNSKEY, now time.Time) error {
+	hasDNAME := false
+	for _, rr := range section {
+		if rr.Header().Rrtype == dns.TypeDNAME {
+			hasDNAME = true
+		}
+	}
+	for _, set := range groupRRsets(section) {
+		if hasDNAME && set.rrtype == dns.TypeCNAME {
+			continue
+		}
+		rrset, sigs := rrsetFromSection(section, set.name, set.rrtype)
+		if err := verifyRRset(rrset, sigs, keys, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDenial checks that a negative response carries signed NSEC or NSEC3
+// records alongside the SOA.
+func verifyDenial(resp *dns.Msg, keys map[string][]*dns.DNSKEY, now time.Time) error {
+	if !hasDenialRecords(resp.Ns) {
+		return errors.New("negative response has no NSEC or NSEC3 records")
+	}
+	return verifySection(resp.Ns, keys, now)
+}
+
+func verifyNoDS(resp *dns.Msg, child string, keys map[string][]*dns.DNSKEY, now time.Time) ([]string, error) {
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("DS query returned %s", dns.RcodeToString[resp.Rcode])
+	}
+	if err := verifyDenial(resp, keys, now); err != nil {
+		return nil, err
+	}
+	return proveDenial(resp, child, dns.TypeDS)
+}
+
+func hasDenialRecords(section []dns.RR) bool {
+	for _, rr := range section {
+		switch rr.Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			return true
+		}
+	}
+	return false
+}
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+func groupRRsets(section []dns.RR) []rrsetKey {
+	seen := map[rrsetKey]bool{}
+	keys := []rrsetKey{}
+	for _, rr := range section {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeRRSIG || header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey{name: strings.ToLower(header.Name), rrtype: header.Rrtype}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func rrsetFromSection(section []dns.RR, name string, rrtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	rrset := []dns.RR{}
+	sigs := []*dns.RRSIG{}
+	for _, rr := range section {
+		header := rr.Header()
+		if !strings.EqualFold(header.Name, name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == rrtype {
+				sigs = append(sigs, sig)
+			}
+			continue
+		}
+		if header.Rrtype == rrtype {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs
+}
+
+func signatureWindowError(header *dns.RR_Header, sig *dns.RRSIG) error {
+	return fmt.Errorf("RRSIG on %s %s by key %d is outside its validity window %s to %s", header.Name, dns.TypeToString[header.Rrtype], sig.KeyTag, dns.TimeToString(sig.Inception), dns.TimeToString(sig.Expiration))
+}
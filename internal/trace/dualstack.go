@@ -0,0 +1,148 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+)
+
+// TraceDualStack runs the delegation trace once over IPv4 and once over IPv6
+// and reports zones that only answer over one family.
+func (t *Tracer) TraceDualStack(ctx context.Context, fqdn string, rrtype string) (model.TraceResult, error) {
+	families := []Family{FamilyIPv4, FamilyIPv6}
+	results := map[Family]model.TraceResult{}
+	offsets := map[Family]int{}
+	combined := model.TraceResult{}
+
+	for _, family := range families {
+		sub := *t
+		sub.config.Family = family
+		// Each family resolves nameservers itself, so a lookup that only
+		// works over one family is not answered from the other's cache.
+		sub.cache = newCache()
+		res, err := sub.Trace(ctx, fqdn, rrtype)
+		if err != nil {
+			return model.TraceResult{}, err
+		}
+		offset := len(combined.TraceSteps)
+		offsets[family] = offset
+		for _, step := range res.TraceSteps {
+			step.Index += offset
+			step.Family = string(family)
+			combined.TraceSteps = append(combined.TraceSteps, step)
+		}
+		for _, timing := range res.Timings {
+			timing.StepIndex += offset
+			combined.Timings = append(combined.Timings, timing)
+		}
+		combined.Cookies = append(combined.Cookies, res.Cookies...)
+		for _, check := range res.SOA {
+			check.Step += offset
+			combined.SOA = append(combined.SOA, check)
+		}
+		for _, check := range res.Nameservers {
+			check.Step += offset
+			combined.Nameservers = append(combined.Nameservers, check)
+		}
+		for _, sub := range res.SubTraces {
+			sub.ParentStep += offset
+			combined.SubTraces = append(combined.SubTraces, sub)
+		}
+		results[family] = res
+	}
+
+	combined.Diagnosis = compareFamilies(results[FamilyIPv4], results[FamilyIPv6], offsets[FamilyIPv4], offsets[FamilyIPv6])
+	combined.Diagnosis.Warnings = uniqueStrings(append(append([]string{}, results[FamilyIPv4].Diagnosis.Warnings...), results[FamilyIPv6].Diagnosis.Warnings...))
+	return combined, nil
+}
+
+func compareFamilies(v4, v6 model.TraceResult, v4Offset, v6Offset int) model.Diagnosis {
+	hints := zoneFamilyDifferences(v4.TraceSteps, v6.TraceSteps)
+	v4Diag := shiftDiagnosis(v4.Diagnosis, v4Offset)
+	v6Diag := shiftDiagnosis(v6.Diagnosis, v6Offset)
+
+	if v4Diag.Classification == v6Diag.Classification {
+		v4Diag.Summary = fmt.Sprintf("%s (same result over IPv4 and IPv6)", v4Diag.Summary)
+		v4Diag.Hints = append(hints, v4Diag.Hints...)
+		return v4Diag
+	}
+
+	evidence := -1
+	switch {
+	case v4Diag.Classification == string(analyze.OutcomeSuccess) && len(v6Diag.EvidenceSteps) > 0:
+		evidence = v6Diag.EvidenceSteps[0]
+	case len(v4Diag.EvidenceSteps) > 0:
+		evidence = v4Diag.EvidenceSteps[0]
+	}
+	for _, hint := range v4Diag.Hints {
+		hints = append(hints, "ipv4: "+hint)
+	}
+	for _, hint := range v6Diag.Hints {
+		hints = append(hints, "ipv6: "+hint)
+	}
+	return analyze.Diagnose(analyze.Outcome{
+		Kind:         analyze.OutcomeAddressFamily,
+		Summary:      fmt.Sprintf("IPv4 %s (%s), IPv6 %s (%s)", v4Diag.Classification, v4Diag.Summary, v6Diag.Classification, v6Diag.Summary),
+		EvidenceStep: evidence,
+		Hints:        hints,
+	})
+}
+
+// zoneFamilyDifferences lists zones whose servers answered over only one
+// address family, or that were only reached over one family.
+func zoneFamilyDifferences(v4Steps, v6Steps []model.TraceStep) []string {
+	order := []string{}
+	v4 := zoneHealth(v4Steps, &order)
+	v6 := zoneHealth(v6Steps, &order)
+
+	hints := []string{}
+	for _, zone := range order {
+		v4OK, v4Seen := v4[zone]
+		v6OK, v6Seen := v6[zone]
+		switch {
+		case v4Seen && !v6Seen:
+			hints = append(hints, fmt.Sprintf("zone %s reached over IPv4 only", zone))
+		case v6Seen && !v4Seen:
+			hints = append(hints, fmt.Sprintf("zone %s reached over IPv6 only", zone))
+		case v4OK && !v6OK:
+			hints = append(hints, fmt.Sprintf("zone %s nameservers answer over IPv4 only", zone))
+		case v6OK && !v4OK:
+			hints = append(hints, fmt.Sprintf("zone %s nameservers answer over IPv6 only", zone))
+		}
+	}
+	return hints
+}
+
+func zoneHealth(steps []model.TraceStep, order *[]string) map[string]bool {
+	health := map[string]bool{}
+	for _, step := range steps {
+		if step.Zone == "" {
+			continue
+		}
+		if _, ok := health[step.Zone]; !ok {
+			seen := false
+			for _, zone := range *order {
+				if zone == step.Zone {
+					seen = true
+					break
+				}
+			}
+			if !seen {
+				*order = append(*order, step.Zone)
+			}
+		}
+		health[step.Zone] = health[step.Zone] || (step.Error == "" && step.Rcode != "SERVFAIL" && step.Rcode != "REFUSED")
+	}
+	return health
+}
+
+func shiftDiagnosis(diagnosis model.Diagnosis, offset int) model.Diagnosis {
+	steps := make([]int, 0, len(diagnosis.EvidenceSteps))
+	for _, step := range diagnosis.EvidenceSteps {
+		steps = append(steps, step+offset)
+	}
+	diagnosis.EvidenceSteps = steps
+	return diagnosis
+}
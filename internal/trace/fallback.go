@@ -0,0 +1,105 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+// zoneServers tracks the nameserver names of the zone being queried and the
+// addresses already tried, so a failed hop can move on to the rest the way a
+// resolver would.
+type zoneServers struct {
+	names []string
+	tried map[string]bool
+}
+
+func newZoneServers(names []string) *zoneServers {
+	return &zoneServers{names: names, tried: map[string]bool{}}
+}
+
+func (z *zoneServers) mark(servers []string) {
+	for _, server := range servers {
+		z.tried[server] = true
+	}
+}
+
+// fallback records the failed responses of a hop as abandoned and returns
+// addresses for the zone's nameservers that have not been tried yet,
+// resolving every NS name over each address family. It returns no servers
+// when the zone has none left.
+func (t *Tracer) fallback(ctx context.Context, zone string, known *zoneServers, responses []response, best *response, qname string, qtype uint16, serverLabels map[string]string, result *model.TraceResult) ([]string, map[string]string, []string) {
+	warnings := t.abandon(responses, best, qname, qtype, zone, serverLabels, result)
+	if len(known.names) == 0 {
+		return nil, nil, warnings
+	}
+	addresses, labels := t.resolveLabelled(ctx, known.names, result)
+	next := []string{}
+	for _, address := range addresses {
+		if !known.tried[address] {
+			next = append(next, address)
+		}
+	}
+	if len(next) == 0 {
+		warnings = append(warnings, fmt.Sprintf("all %d nameserver addresses for %s failed", len(known.tried), zone))
+	}
+	return next, labels, warnings
+}
+
+// abandon marks each failed response as abandoned, adding a step for every
+// server that the summary step did not cover.
+func (t *Tracer) abandon(responses []response, best *response, qname string, qtype uint16, zone string, serverLabels map[string]string, result *model.TraceResult) []string {
+	warnings := []string{}
+	for _, r := range responses {
+		step := r.stepIndex
+		if !t.config.Verbose {
+			if best != nil && r.server == best.server {
+				step = best.stepIndex
+			} else {
+				step = len(result.TraceSteps)
+				result.TraceSteps = append(result.TraceSteps, buildStep(step, qname, qtype, zone, r, serverLabels))
+				result.Timings = append(result.Timings, buildTiming(step, r))
+			}
+		}
+		noteStep(result, step, "abandoned")
+		warnings = append(warnings, fmt.Sprintf("abandoned %s for %s: %s", serverName(r.server, serverLabels), zone, failureReason(r)))
+	}
+	return warnings
+}
+
+// resolveLabelled resolves each nameserver name and labels its addresses
+// with the name.
+func (t *Tracer) resolveLabelled(ctx context.Context, names []string, result *model.TraceResult) ([]string, map[string]string) {
+	addresses := []string{}
+	labels := map[string]string{}
+	for _, name := range names {
+		resolved, err := t.resolveNameserverAddresses(ctx, "", []string{name}, result)
+		if err != nil {
+			continue
+		}
+		for _, address := range resolved {
+			labels[address] = name
+		}
+		addresses = append(addresses, resolved...)
+	}
+	return uniqueStrings(addresses), labels
+}
+
+func failureReason(r response) string {
+	switch {
+	case r.err != nil && errors.Is(r.err, context.DeadlineExceeded):
+		return "timeout"
+	case r.err != nil:
+		return r.err.Error()
+	case r.resp == nil:
+		return "empty response"
+	case isReferral(r.resp):
+		return "delegation without glue"
+	case r.resp.Rcode == dns.RcodeSuccess && !r.resp.Authoritative:
+		return "not authoritative"
+	}
+	return dns.RcodeToString[r.resp.Rcode]
+}
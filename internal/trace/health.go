@@ -0,0 +1,219 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+const (
+	signatureOK       = "ok"
+	signatureExpiring = "expiring"
+	signatureExpired  = "expired"
+	signaturePending  = "not yet valid"
+)
+
+// Health walks the chain of trust down to zone and reports signature windows
+// and key state at every zone cut. Signatures that expire within warnWithin
+// are flagged.
+func (t *Tracer) Health(ctx context.Context, zone string, warnWithin time.Duration) (model.HealthReport, error) {
+	tracer := t.run()
+	tracer.config.DNSSEC = true
+	result, chain, err := tracer.trace(ctx, zone, "SOA", nil)
+	if err != nil {
+		return model.HealthReport{}, err
+	}
+	report := model.HealthReport{
+		Zone:       dns.Fqdn(zone),
+		TraceSteps: result.TraceSteps,
+		Timings:    result.Timings,
+	}
+	if chain == nil {
+		report.Diagnosis = result.Diagnosis
+		return report, nil
+	}
+	for _, cut := range chain.cuts {
+		report.Zones = append(report.Zones, cutHealth(cut, chain.now, warnWithin))
+	}
+	report.Diagnosis = healthDiagnosis(result.Diagnosis, report.Zones, warnWithin)
+	return report, nil
+}
+
+func cutHealth(cut *zoneCut, now time.Time, warnWithin time.Duration) model.ZoneHealth {
+	health := model.ZoneHealth{Zone: cut.zone, Status: string(cut.status)}
+	for _, step := range cut.steps {
+		if step >= 0 {
+			health.EvidenceSteps = append(health.EvidenceSteps, step)
+		}
+	}
+
+	signing := map[uint16]bool{}
+	signsKeys := map[uint16]bool{}
+	for _, sig := range cut.sigs {
+		signing[sig.KeyTag] = true
+		if sig.TypeCovered == dns.TypeDNSKEY {
+			signsKeys[sig.KeyTag] = true
+		}
+	}
+
+	matched := map[uint16]bool{}
+	active := false
+	for _, ds := range cut.ds {
+		info := model.DSInfo{KeyTag: ds.KeyTag, Algorithm: algorithmName(ds.Algorithm), DigestType: ds.DigestType}
+		for _, key := range cut.keys {
+			if !dsMatchesKey(ds, key) {
+				continue
+			}
+			info.MatchesKey = true
+			matched[key.KeyTag()] = true
+			info.ActiveKSK = signsKeys[key.KeyTag()]
+		}
+		switch {
+		case len(cut.keys) == 0:
+		case !info.MatchesKey:
+			health.Issues = append(health.Issues, fmt.Sprintf("DS %d has no matching DNSKEY", ds.KeyTag))
+		case !info.ActiveKSK:
+			health.Issues = append(health.Issues, fmt.Sprintf("DS %d matches a key that does not sign the DNSKEY RRset", ds.KeyTag))
+		}
+		active = active || info.ActiveKSK
+		health.DS = append(health.DS, info)
+	}
+	if len(cut.ds) > 0 && len(cut.keys) > 0 && !active {
+		health.Issues = append(health.Issues, "no DS matches an active KSK")
+	}
+
+	// A key that signed nothing seen during the walk is reported as stand-by,
+	// which covers pre-published KSKs and ZSKs during a rollover.
+	for _, key := range cut.keys {
+		info := model.KeyInfo{
+			KeyTag:    key.KeyTag(),
+			Algorithm: algorithmName(key.Algorithm),
+			Flags:     key.Flags,
+			Role:      "ZSK",
+			MatchesDS: matched[key.KeyTag()],
+			Signing:   signing[key.KeyTag()],
+			Revoked:   key.Flags&dns.REVOKE != 0,
+		}
+		if key.Flags&dns.SEP != 0 {
+			info.Role = "KSK"
+		}
+		info.Standby = !info.Revoked && !info.Signing
+		if info.Revoked && info.Signing {
+			health.Issues = append(health.Issues, fmt.Sprintf("revoked key %d still signs records", info.KeyTag))
+		}
+		health.Keys = append(health.Keys, info)
+	}
+
+	seen := map[string]bool{}
+	for _, sig := range cut.sigs {
+		id := fmt.Sprintf("%s/%d/%d/%d", strings.ToLower(sig.Hdr.Name), sig.TypeCovered, sig.KeyTag, sig.Expiration)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		info := signatureHealth(sig, now, warnWithin)
+		switch info.Status {
+		case signatureExpired:
+			health.Issues = append(health.Issues, fmt.Sprintf("RRSIG on %s %s by key %d expired %s ago", info.Owner, info.Covers, info.KeyTag, formatDays(-info.Expiration.Sub(now))))
+		case signatureExpiring:
+			health.Issues = append(health.Issues, fmt.Sprintf("RRSIG on %s %s by key %d expires in %s", info.Owner, info.Covers, info.KeyTag, info.Remaining))
+		case signaturePending:
+			health.Issues = append(health.Issues, fmt.Sprintf("RRSIG on %s %s by key %d is not valid until %s", info.Owner, info.Covers, info.KeyTag, info.Inception.Format(time.RFC3339)))
+		}
+		health.Signatures = append(health.Signatures, info)
+	}
+	sort.SliceStable(health.Signatures, func(i, j int) bool {
+		return health.Signatures[i].Expiration.Before(health.Signatures[j].Expiration)
+	})
+	return health
+}
+
+func signatureHealth(sig *dns.RRSIG, now time.Time, warnWithin time.Duration) model.SignatureInfo {
+	inception := time.Unix(int64(sig.Inception), 0).UTC()
+	expiration := time.Unix(int64(sig.Expiration), 0).UTC()
+	info := model.SignatureInfo{
+		Owner:      sig.Hdr.Name,
+		Covers:     dns.TypeToString[sig.TypeCovered],
+		KeyTag:     sig.KeyTag,
+		Inception:  inception,
+		Expiration: expiration,
+		Remaining:  formatDays(expiration.Sub(now)),
+		Status:     signatureOK,
+	}
+	switch {
+	case now.After(expiration):
+		info.Status = signatureExpired
+	case now.Before(inception):
+		info.Status = signaturePending
+	case expiration.Sub(now) <= warnWithin:
+		info.Status = signatureExpiring
+	}
+	return info
+}
+
+func healthDiagnosis(traced model.Diagnosis, zones []model.ZoneHealth, warnWithin time.Duration) model.Diagnosis {
+	issues := []string{}
+	steps := []int{}
+	flagged := 0
+	for _, zone := range zones {
+		for _, issue := range zone.Issues {
+			issues = append(issues, fmt.Sprintf("%s: %s", zone.Zone, issue))
+		}
+		zoneFlagged := false
+		for _, sig := range zone.Signatures {
+			if sig.Status != signatureOK {
+				flagged++
+				zoneFlagged = true
+			}
+		}
+		if zoneFlagged {
+			steps = append(steps, zone.EvidenceSteps...)
+		}
+	}
+	if traced.Classification != string(analyze.OutcomeSuccess) || flagged == 0 {
+		traced.Hints = append(traced.Hints, issues...)
+		if traced.Classification == string(analyze.OutcomeSuccess) {
+			traced.Summary = fmt.Sprintf("chain of trust healthy across %d zones", len(zones))
+		}
+		return traced
+	}
+	diagnosis := analyze.Diagnose(analyze.Outcome{
+		Kind:          analyze.OutcomeDNSSECExpiring,
+		Summary:       fmt.Sprintf("%d signatures expired or expire within %s", flagged, formatDays(warnWithin)),
+		EvidenceStep:  -1,
+		EvidenceSteps: steps,
+		Hints:         issues,
+	})
+	diagnosis.Warnings = traced.Warnings
+	return diagnosis
+}
+
+func dsMatchesKey(ds *dns.DS, key *dns.DNSKEY) bool {
+	if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+		return false
+	}
+	digest := key.ToDS(ds.DigestType)
+	return digest != nil && strings.EqualFold(digest.Digest, ds.Digest)
+}
+
+func algorithmName(algorithm uint8) string {
+	if name, ok := dns.AlgorithmToString[algorithm]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", algorithm)
+}
+
+func formatDays(d time.Duration) string {
+	if d < 0 {
+		return "-" + formatDays(-d)
+	}
+	days := d / (24 * time.Hour)
+	hours := (d % (24 * time.Hour)) / time.Hour
+	return fmt.Sprintf("%dd%dh", days, hours)
+}
@@ -0,0 +1,174 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+// maxMinimiseCount caps the number of minimised queries per name, as
+// MAX_MINIMISE_COUNT does in RFC 9156 section 2.3.
+const maxMinimiseCount = 10
+
+// minimisation tracks a QNAME-minimised walk (RFC 9156). known is the longest
+// ancestor of the query name that a server has already confirmed.
+type minimisation struct {
+	active   bool
+	known    string
+	count    int
+	failure  *minimisedFailure
+	warnings []string
+}
+
+// minimisedFailure is a minimised query that a resolver would have stopped
+// at, recorded so it can be compared with the full-name answer.
+type minimisedFailure struct {
+	step   int
+	server string
+	qname  string
+	rcode  string
+}
+
+func newMinimisation() *minimisation {
+	return &minimisation{active: true, known: "."}
+}
+
+// next returns the name and type to send to the servers for zone: one label
+// more than is already known, with type NS, or the full query once the name
+// is reached.
+func (m *minimisation) next(name string, qtype uint16, zone string) (string, uint16) {
+	if m == nil || !m.active || !dns.IsSubDomain(zone, name) {
+		return name, qtype
+	}
+	if !dns.IsSubDomain(m.known, name) || dns.CountLabel(zone) > dns.CountLabel(m.known) {
+		m.known = zone
+	}
+	labels := dns.CountLabel(m.known) + 1
+	if labels >= dns.CountLabel(name) || m.count >= maxMinimiseCount {
+		return name, qtype
+	}
+	m.count++
+	return ancestor(name, labels), dns.TypeNS
+}
+
+// minimised handles the answer to a minimised NS query that was not a
+// referral and returns the zone the walk continues in. A zone cut hosted on
+// the same servers moves the walk into the child zone; NODATA confirms an
+// empty non-terminal or a name without a cut; anything else stops
+// minimisation so the next hop sends the full name.
+func (t *Tracer) minimised(ctx context.Context, m *minimisation, chain *dnssecChain, best *response, qname string, zone string, servers []string, serverLabels map[string]string, result *model.TraceResult) string {
+	resp := best.resp
+	note := ""
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && resp.Authoritative && hasAnswerType(resp, dns.TypeNS):
+		note = fmt.Sprintf("qname-min cut=%s", qname)
+		if chain != nil {
+			t.extendChain(ctx, chain, zone, servers, serverLabels, qname, servers, serverLabels, result)
+		}
+		m.known = qname
+		zone = qname
+	case resp.Rcode == dns.RcodeSuccess && resp.Authoritative && len(resp.Answer) == 0:
+		note = "qname-min no-cut"
+		if emptyNonTerminal(resp, qname) {
+			note = "qname-min ent"
+		}
+		m.known = qname
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		note = "qname-min stop"
+		m.active = false
+	default:
+		note = "qname-min fallback"
+		m.active = false
+		if m.failure == nil {
+			m.failure = &minimisedFailure{
+				step:   best.stepIndex,
+				server: serverName(best.server, serverLabels),
+				qname:  qname,
+				rcode:  responseStatus(*best),
+			}
+		}
+	}
+	noteStep(result, best.stepIndex, note)
+	return zone
+}
+
+// checkServers warns about servers that answered a minimised query with an
+// error while the best response shows the name exists.
+func (m *minimisation) checkServers(responses []response, best *response, qname string, serverLabels map[string]string) {
+	if best == nil || best.resp == nil || best.resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, r := range responses {
+		if r.resp == nil || r.resp.Rcode == dns.RcodeSuccess {
+			continue
+		}
+		m.warnings = append(m.warnings, fmt.Sprintf("%s answered minimised query %s NS with %s", serverName(r.server, serverLabels), qname, dns.RcodeToString[r.resp.Rcode]))
+	}
+}
+
+// diagnose reports a minimised query that failed where the full query did
+// not: a minimising resolver would stop at that step.
+func (m *minimisation) diagnose(diagnosis model.Diagnosis) model.Diagnosis {
+	if m == nil {
+		return diagnosis
+	}
+	diagnosis.Warnings = append(diagnosis.Warnings, m.warnings...)
+	if m.failure == nil {
+		return diagnosis
+	}
+	switch analyze.OutcomeKind(diagnosis.Classification) {
+	case analyze.OutcomeSuccess, analyze.OutcomeNODATA, analyze.OutcomeDNSSECInsecure:
+	default:
+		return diagnosis
+	}
+	outcome := analyze.Outcome{
+		Kind:          analyze.OutcomeQNameMinimisation,
+		Summary:       fmt.Sprintf("%s answered %s for minimised query %s NS but the full query resolves (%s)", m.failure.server, m.failure.rcode, m.failure.qname, diagnosis.Summary),
+		EvidenceStep:  m.failure.step,
+		EvidenceSteps: diagnosis.EvidenceSteps,
+		Records:       diagnosis.Records,
+		Hints: append([]string{
+			fmt.Sprintf("resolvers using QNAME minimisation stop at %s", m.failure.qname),
+			"empty non-terminals must answer NOERROR with no data (RFC 8020)",
+		}, diagnosis.Hints...),
+	}
+	result := analyze.Diagnose(outcome)
+	result.Warnings = diagnosis.Warnings
+	return result
+}
+
+// emptyNonTerminal reports whether the denial records in a NODATA response
+// show that name owns no records but has descendants: an NSEC3 with an empty
+// type bitmap (RFC 5155 section 7.1) or an NSEC whose next name is below it.
+// Servers only include them when the DO bit is set, which --dnssec does.
+func emptyNonTerminal(resp *dns.Msg, name string) bool {
+	proof := collectDenial(resp.Ns)
+	if nsec3 := proof.nsec3Matching(name); nsec3 != nil {
+		return len(nsec3.TypeBitMap) == 0
+	}
+	if proof.nsecMatching(name) != nil {
+		return false
+	}
+	if nsec := proof.nsecCovering(name); nsec != nil {
+		return dns.IsSubDomain(name, nsec.NextDomain) && !strings.EqualFold(name, nsec.NextDomain)
+	}
+	return false
+}
+
+func serverName(server string, serverLabels map[string]string) string {
+	if label := serverLabels[server]; label != "" {
+		return fmt.Sprintf("%s (%s)", label, server)
+	}
+	return server
+}
+
+func responseStatus(r response) string {
+	if r.resp.Rcode == dns.RcodeSuccess && !r.resp.Authoritative {
+		return "a non-authoritative answer"
+	}
+	return dns.RcodeToString[r.resp.Rcode]
+}
@@ -0,0 +1,182 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+// walkEnd is where a walk stopped: its last step, the name it was resolving
+// after any CNAME or DNAME, and the zone and servers it last queried.
+type walkEnd struct {
+	step    int
+	name    string
+	zone    string
+	servers []string
+	labels  map[string]string
+}
+
+// TraceTypes traces the delegation once for the first record type and then
+// asks the final zone's servers for each of the others, adding a result per
+// type to one TraceResult.
+func (t *Tracer) TraceTypes(ctx context.Context, fqdn string, rrtypes []string) (model.TraceResult, error) {
+	if len(rrtypes) == 0 {
+		return model.TraceResult{}, fmt.Errorf("no rrtype given")
+	}
+	qtypes := make([]uint16, 0, len(rrtypes))
+	for _, rrtype := range rrtypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(rrtype)]
+		if !ok {
+			return model.TraceResult{}, fmt.Errorf("unsupported rrtype: %s", rrtype)
+		}
+		qtypes = append(qtypes, qtype)
+	}
+
+	t = t.run()
+	var end walkEnd
+	result, chain, err := t.trace(ctx, fqdn, rrtypes[0], &end)
+	if err != nil {
+		return model.TraceResult{}, err
+	}
+	first, authoritative := firstTypeResult(result, end.step, qtypes[0])
+	result.Types = []model.TypeResult{first}
+	for _, qtype := range qtypes[1:] {
+		if !authoritative {
+			result.Types = append(result.Types, model.TypeResult{
+				QueryType: dns.TypeToString[qtype],
+				Step:      -1,
+				Diagnosis: model.Diagnosis{
+					Classification: first.Diagnosis.Classification,
+					Summary:        "not queried: the trace did not reach an authoritative server",
+				},
+			})
+			continue
+		}
+		result.Types = append(result.Types, t.queryType(ctx, end, qtype, chain, &result))
+	}
+	result.Diagnosis = typesDiagnosis(result.Diagnosis, result.Types)
+	return result, nil
+}
+
+// firstTypeResult takes the result for the traced type from the walk and
+// reports whether the walk ended at an authoritative answer.
+func firstTypeResult(result model.TraceResult, final int, qtype uint16) (model.TypeResult, bool) {
+	typeResult := model.TypeResult{
+		QueryType: dns.TypeToString[qtype],
+		Step:      final,
+		Diagnosis: result.Diagnosis,
+	}
+	authoritative := false
+	for _, step := range result.TraceSteps {
+		if step.Index == final {
+			typeResult.Rcode = step.Rcode
+			typeResult.Answers = step.Answers
+			authoritative = step.Authoritative && step.Error == ""
+		}
+	}
+	return typeResult, authoritative
+}
+
+// queryType asks the servers the walk ended at for qtype. Each type gets its
+// own copy of the DNSSEC chain so one bogus answer does not taint the rest.
+func (t *Tracer) queryType(ctx context.Context, end walkEnd, qtype uint16, chain *dnssecChain, result *model.TraceResult) model.TypeResult {
+	typeResult := model.TypeResult{QueryType: dns.TypeToString[qtype]}
+	best, step := t.queryRecorded(ctx, end.servers, end.name, qtype, end.zone, result, end.labels)
+	noteStep(result, step, "type="+typeResult.QueryType)
+	typeResult.Step = step
+	outcome := analyze.Outcome{EvidenceStep: step}
+	switch {
+	case best == nil:
+		outcome.Kind = analyze.OutcomeServfailTimeout
+		outcome.Summary = "no reachable nameservers"
+	case best.err != nil:
+		outcome.Kind = analyze.OutcomeServfailTimeout
+		outcome.Summary = best.err.Error()
+	case best.resp == nil:
+		outcome.Kind = analyze.OutcomeServfailTimeout
+		outcome.Summary = "empty response from nameserver"
+	default:
+		resp := best.resp
+		typeResult.Rcode = dns.RcodeToString[resp.Rcode]
+		typeResult.Answers = rrStrings(resp.Answer)
+		switch {
+		case resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused:
+			outcome.Kind = analyze.OutcomeServfailTimeout
+			outcome.Summary = dns.RcodeToString[resp.Rcode]
+		case !resp.Authoritative:
+			outcome.Kind = analyze.OutcomeLameDelegation
+			outcome.Summary = "nameserver not authoritative for zone"
+		case resp.Rcode == dns.RcodeNameError:
+			outcome.Kind = analyze.OutcomeNXDOMAIN
+			outcome.Summary = "authoritative NXDOMAIN"
+		case len(resp.Answer) > 0:
+			outcome.Kind = analyze.OutcomeSuccess
+			outcome.Summary = "authoritative answer returned"
+		default:
+			outcome.Kind = analyze.OutcomeNODATA
+			outcome.Summary = "authoritative NODATA"
+		}
+		if chain != nil && resp.Authoritative {
+			typeChain := chain.clone()
+			t.checkResponse(typeChain, resp, end.zone, step, result)
+			outcome = dnssecOutcome(typeChain, outcome)
+		}
+	}
+	typeResult.Diagnosis = analyze.Diagnose(outcome)
+	return typeResult
+}
+
+// typesDiagnosis sums up a multi-type trace. A failed walk or a failed type
+// names the diagnosis; otherwise, when the traced type resolved plainly, it
+// lists which types had records.
+func typesDiagnosis(diagnosis model.Diagnosis, types []model.TypeResult) model.Diagnosis {
+	answered := []string{}
+	empty := []string{}
+	for i, typeResult := range types {
+		if !resolved(typeResult.Diagnosis) {
+			if i == 0 {
+				return diagnosis
+			}
+			failed := typeResult.Diagnosis
+			failed.Summary = fmt.Sprintf("%s: %s", typeResult.QueryType, failed.Summary)
+			failed.Warnings = diagnosis.Warnings
+			return failed
+		}
+		switch analyze.OutcomeKind(typeResult.Diagnosis.Classification) {
+		case analyze.OutcomeSuccess, analyze.OutcomeDNSSECInsecure:
+			answered = append(answered, typeResult.QueryType)
+		default:
+			empty = append(empty, typeResult.QueryType)
+		}
+	}
+	switch analyze.OutcomeKind(diagnosis.Classification) {
+	case analyze.OutcomeSuccess, analyze.OutcomeNODATA:
+	default:
+		return diagnosis
+	}
+	if len(answered) == 0 {
+		return diagnosis
+	}
+	summary := fmt.Sprintf("authoritative answers for %s", strings.Join(answered, ", "))
+	if len(empty) > 0 {
+		summary += fmt.Sprintf("; no data for %s", strings.Join(empty, ", "))
+	}
+	steps := []int{}
+	for _, typeResult := range types {
+		steps = append(steps, typeResult.Step)
+	}
+	result := analyze.Diagnose(analyze.Outcome{
+		Kind:          analyze.OutcomeSuccess,
+		Summary:       summary,
+		EvidenceStep:  -1,
+		EvidenceSteps: steps,
+		Records:       diagnosis.Records,
+		Hints:         diagnosis.Hints,
+	})
+	result.Warnings = diagnosis.Warnings
+	return result
+}
@@ -0,0 +1,143 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+const (
+	nameserverAuthoritative = "authoritative"
+	nameserverLame          = "lame"
+	nameserverUnreachable   = "unreachable"
+	nameserverWrongZone     = "wrong-zone"
+)
+
+// zoneProbe holds the SOA answer from every address of every nameserver in
+// a zone's NS RRset. failure is set when the NS RRset could not be read.
+type zoneProbe struct {
+	zone       string
+	nsStep     int
+	labels     map[string]string
+	responses  []response
+	unresolved []string
+	failure    string
+}
+
+// probeZone reads the NS RRset for the zone of step from step's server,
+// resolves every nameserver over each address family and asks each address
+// for the zone's SOA.
+func (t *Tracer) probeZone(ctx context.Context, step model.TraceStep, result *model.TraceResult) *zoneProbe {
+	probe := &zoneProbe{zone: step.Zone}
+	best, nsStep := t.queryRecorded(ctx, []string{step.Server}, probe.zone, dns.TypeNS, probe.zone, result, map[string]string{step.Server: step.ServerName})
+	noteStep(result, nsStep, "zone-probe")
+	probe.nsStep = nsStep
+	names := []string{}
+	if best != nil {
+		for _, rr := range best.resp.Answer {
+			if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, probe.zone) {
+				names = append(names, strings.ToLower(dns.Fqdn(ns.Ns)))
+			}
+		}
+	}
+	names = uniqueStrings(names)
+	sort.Strings(names)
+	if len(names) == 0 {
+		probe.failure = "could not read the NS RRset"
+		return probe
+	}
+
+	servers, labels := t.resolveLabelled(ctx, names, result)
+	resolved := map[string]bool{}
+	for _, name := range labels {
+		resolved[name] = true
+	}
+	for _, name := range names {
+		if !resolved[name] {
+			probe.unresolved = append(probe.unresolved, name)
+		}
+	}
+	probe.labels = labels
+	probe.responses = t.queryServers(ctx, servers, probe.zone, dns.TypeSOA, probe.zone, result, true, probe.labels)
+	for _, r := range probe.responses {
+		noteStep(result, r.stepIndex, "zone-probe")
+	}
+	return probe
+}
+
+// checkNameservers classifies every nameserver address in the zone probe as
+// authoritative, lame, unreachable or answering for the wrong zone.
+func checkNameservers(probe *zoneProbe) ([]model.NameserverCheck, []consistencyIssue) {
+	if probe.failure != "" {
+		return nil, []consistencyIssue{{kind: analyze.OutcomeLameDelegation, text: fmt.Sprintf("%s: %s", probe.zone, probe.failure), step: probe.nsStep}}
+	}
+	checks := []model.NameserverCheck{}
+	issues := []consistencyIssue{}
+	for _, name := range probe.unresolved {
+		checks = append(checks, model.NameserverCheck{ServerName: name, Step: probe.nsStep, Status: nameserverUnreachable, Detail: "no address records"})
+		issues = append(issues, consistencyIssue{
+			kind: analyze.OutcomeLameDelegation,
+			text: fmt.Sprintf("%s: %s is unreachable: no address records", probe.zone, name),
+			step: probe.nsStep,
+		})
+	}
+	for _, r := range probe.responses {
+		status, detail := classifyNameserver(r, probe.zone)
+		checks = append(checks, model.NameserverCheck{
+			Server:     r.server,
+			ServerName: probe.labels[r.server],
+			Family:     string(serverFamily(r.server)),
+			Step:       r.stepIndex,
+			Status:     status,
+			Detail:     detail,
+		})
+		if status == nameserverAuthoritative {
+			continue
+		}
+		issues = append(issues, consistencyIssue{
+			kind: analyze.OutcomeLameDelegation,
+			text: fmt.Sprintf("%s: %s is %s: %s", probe.zone, serverName(r.server, probe.labels), status, detail),
+			step: r.stepIndex,
+		})
+	}
+	return checks, issues
+}
+
+// classifyNameserver decides how a nameserver handled a SOA query for the
+// apex of zone.
+func classifyNameserver(r response, zone string) (string, string) {
+	if r.err != nil {
+		return nameserverUnreachable, r.err.Error()
+	}
+	resp := r.resp
+	if resp == nil {
+		return nameserverUnreachable, "empty response"
+	}
+	if answerSOA(r, zone) != nil {
+		return nameserverAuthoritative, "SOA answered with AA set"
+	}
+	if resp.Rcode == dns.RcodeRefused || resp.Rcode == dns.RcodeServerFailure {
+		return nameserverLame, dns.RcodeToString[resp.Rcode]
+	}
+	if isReferral(resp) {
+		_, target := nsNamesAndZone(resp)
+		if dns.IsSubDomain(target, zone) && !strings.EqualFold(target, zone) {
+			return nameserverLame, fmt.Sprintf("referral upward to %s", target)
+		}
+		return nameserverWrongZone, fmt.Sprintf("referral to %s", target)
+	}
+	if !resp.Authoritative {
+		return nameserverLame, fmt.Sprintf("%s without AA", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range append(append([]dns.RR{}, resp.Answer...), resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok && !strings.EqualFold(soa.Hdr.Name, zone) {
+			return nameserverWrongZone, fmt.Sprintf("%s with SOA for %s", dns.RcodeToString[resp.Rcode], soa.Hdr.Name)
+		}
+	}
+	return nameserverLame, fmt.Sprintf("%s with AA but no SOA", dns.RcodeToString[resp.Rcode])
+}
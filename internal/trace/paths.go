@@ -0,0 +1,193 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+// TraceAllPaths runs the delegation trace and then follows every distinct
+// referral from every nameserver instead of only the best one. The tree of
+// servers and zones is returned in result.Paths, and servers whose answers
+// differ from their siblings are reported in the diagnosis.
+func (t *Tracer) TraceAllPaths(ctx context.Context, fqdn string, rrtype string) (model.TraceResult, error) {
+	t = t.run()
+	result, _, err := t.trace(ctx, fqdn, rrtype, nil)
+	if err != nil {
+		return model.TraceResult{}, err
+	}
+	explorer := &pathExplorer{
+		tracer:  t,
+		name:    dns.Fqdn(fqdn),
+		qtype:   dns.StringToType[strings.ToUpper(rrtype)],
+		result:  &result,
+		visited: map[string]bool{},
+	}
+	result.Paths = explorer.explore(ctx, ".", t.startServers(), t.rootLabels(), 0)
+	result.Diagnosis = pathsDiagnosis(result.Diagnosis, explorer.issues, explorer.steps, explorer.servers)
+	return result, nil
+}
+
+type pathExplorer struct {
+	tracer  *Tracer
+	name    string
+	qtype   uint16
+	result  *model.TraceResult
+	visited map[string]bool
+	issues  []string
+	steps   []int
+	servers int
+}
+
+// explore asks every server for the name and follows each distinct referral
+// once; referrals that differ only in glue count as distinct. A zone reached
+// again with the same servers is not queried twice.
+func (e *pathExplorer) explore(ctx context.Context, zone string, servers []string, serverLabels map[string]string, depth int) *model.PathZone {
+	node := &model.PathZone{Zone: zone}
+	sorted := append([]string{}, servers...)
+	sort.Strings(sorted)
+	key := zone + " " + strings.Join(sorted, ",")
+	if e.visited[key] || depth >= e.tracer.config.MaxHops {
+		return node
+	}
+	e.visited[key] = true
+
+	responses := e.tracer.queryServers(ctx, servers, e.name, e.qtype, zone, e.result, true, serverLabels)
+	keys := make([]string, len(responses))
+	followed := map[string]bool{}
+	for i, r := range responses {
+		e.servers++
+		step := &e.result.TraceSteps[r.stepIndex]
+		step.Note = appendNote(step.Note, "all-paths")
+		var outcome string
+		keys[i], outcome = pathOutcome(r)
+		pathNode := model.PathNode{Server: r.server, ServerName: serverLabels[r.server], Step: r.stepIndex, Outcome: outcome}
+		if r.err == nil && r.resp != nil && isReferral(r.resp) && !followed[keys[i]] {
+			followed[keys[i]] = true
+			if next, nextLabels, nextZone := e.referral(ctx, r.resp); len(next) > 0 {
+				pathNode.Referral = e.explore(ctx, nextZone, next, nextLabels, depth+1)
+			}
+		}
+		node.Servers = append(node.Servers, pathNode)
+	}
+	e.compare(node, keys, serverLabels)
+	return node
+}
+
+// referral returns the servers a referral points at, resolving
+// out-of-bailiwick nameservers when there is no usable glue.
+func (e *pathExplorer) referral(ctx context.Context, resp *dns.Msg) ([]string, map[string]string, string) {
+	nsNames, zone := nsNamesAndZone(resp)
+	servers := e.tracer.filterFamily(extractGlueServers(resp))
+	if len(servers) > 0 {
+		return servers, extractGlueLabels(resp), zone
+	}
+	_, outOfBailiwick := splitBailiwick(nsNames, zone)
+	if len(outOfBailiwick) == 0 {
+		return nil, nil, zone
+	}
+	resolved, err := e.tracer.resolveNameserverAddresses(ctx, zone, outOfBailiwick, e.result)
+	if err != nil {
+		return nil, nil, zone
+	}
+	return resolved, map[string]string{}, zone
+}
+
+// compare flags servers whose answer differs from the one most of their
+// siblings gave.
+func (e *pathExplorer) compare(node *model.PathZone, keys []string, serverLabels map[string]string) {
+	counts := map[string]int{}
+	majority := ""
+	majorityOutcome := ""
+	for i, key := range keys {
+		counts[key]++
+		if counts[key] > counts[majority] {
+			majority = key
+			majorityOutcome = node.Servers[i].Outcome
+		}
+	}
+	if len(counts) < 2 {
+		return
+	}
+	for i := range node.Servers {
+		if keys[i] == majority {
+			continue
+		}
+		server := &node.Servers[i]
+		server.Issue = fmt.Sprintf("answered %s while %d of %d servers answered %s", server.Outcome, counts[majority], len(keys), majorityOutcome)
+		e.issues = append(e.issues, fmt.Sprintf("zone %s: %s %s", node.Zone, serverName(server.Server, serverLabels), server.Issue))
+		e.steps = append(e.steps, server.Step)
+	}
+}
+
+// pathOutcome returns a comparison key and a readable outcome for one
+// server's response. TTLs are left out so that caches of different ages
+// compare equal.
+func pathOutcome(r response) (string, string) {
+	switch {
+	case r.err != nil && errors.Is(r.err, context.DeadlineExceeded):
+		return "timeout", "timeout"
+	case r.err != nil:
+		return "error", "error: " + r.err.Error()
+	case r.resp == nil:
+		return "error", "empty response"
+	}
+	resp := r.resp
+	switch {
+	case isReferral(resp):
+		names, zone := nsNamesAndZone(resp)
+		sort.Strings(names)
+		glue := []string{}
+		for name, addresses := range glueByName(resp) {
+			for _, address := range addresses {
+				glue = append(glue, name+"="+address)
+			}
+		}
+		sort.Strings(glue)
+		outcome := "referral to " + zone
+		if len(glue) > 0 {
+			outcome += " glue " + strings.Join(glue, " ")
+		}
+		return "referral " + zone + " " + strings.Join(names, ",") + " " + strings.Join(glue, ","), outcome
+	case resp.Rcode == dns.RcodeSuccess && !resp.Authoritative:
+		return "lame", "not authoritative"
+	case resp.Rcode != dns.RcodeSuccess:
+		rcode := dns.RcodeToString[resp.Rcode]
+		return rcode, rcode
+	case len(resp.Answer) == 0:
+		return "NODATA", "NODATA"
+	}
+	data := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		data = append(data, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	sort.Strings(data)
+	return "answer " + strings.Join(data, ","), "NOERROR " + strings.Join(data, ", ")
+}
+
+func pathsDiagnosis(diagnosis model.Diagnosis, issues []string, steps []int, servers int) model.Diagnosis {
+	if len(issues) == 0 {
+		diagnosis.Summary = fmt.Sprintf("%s (all %d server responses agree)", diagnosis.Summary, servers)
+		return diagnosis
+	}
+	if !resolved(diagnosis) {
+		diagnosis.Hints = append(diagnosis.Hints, issues...)
+		return diagnosis
+	}
+	result := analyze.Diagnose(analyze.Outcome{
+		Kind:          analyze.OutcomeInconsistentServers,
+		Summary:       fmt.Sprintf("%d of %d nameserver responses differ from their siblings; best path: %s %s", len(issues), servers, diagnosis.Classification, diagnosis.Summary),
+		EvidenceStep:  -1,
+		EvidenceSteps: append(steps, diagnosis.EvidenceSteps...),
+		Records:       diagnosis.Records,
+		Hints:         append(issues, diagnosis.Hints...),
+	})
+	result.Warnings = diagnosis.Warnings
+	return result
+}
@@ -0,0 +1,106 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+// prime sends a ". NS" query to the root hints as the first step of a trace
+// and replaces them with the NS set and glue from the answer (RFC 8109). It
+// returns warnings describing how the answer differs from the configured
+// root hints.
+func (t *Tracer) prime(ctx context.Context, result *model.TraceResult) []string {
+	primed, step, err := t.primingQuery(ctx, result)
+	noteStep(result, step, "priming")
+	if err != nil {
+		return []string{fmt.Sprintf("%v; using configured root hints", err)}
+	}
+	warnings := compareRootHints(t.configuredHints, primed)
+	t.setRootHints(primed)
+	return warnings
+}
+
+// primingQuery asks the root hints for ". NS" and only accepts an
+// authoritative NOERROR answer with the root NS set and server addresses.
+func (t *Tracer) primingQuery(ctx context.Context, result *model.TraceResult) (RootHints, int, error) {
+	best, step := t.queryRecorded(ctx, t.startServers(), ".", dns.TypeNS, ".", result, t.rootLabels())
+	switch {
+	case best == nil:
+		return RootHints{}, step, errors.New("root priming query failed")
+	case best.resp.Rcode != dns.RcodeSuccess:
+		return RootHints{}, step, fmt.Errorf("root priming response from %s is %s", best.server, dns.RcodeToString[best.resp.Rcode])
+	case !best.resp.Authoritative || !hasAnswerType(best.resp, dns.TypeNS):
+		return RootHints{}, step, fmt.Errorf("root priming response from %s is not an authoritative root NS set", best.server)
+	}
+	primed := rootHintsFromRecords(append(append([]dns.RR{}, best.resp.Answer...), best.resp.Extra...))
+	if primed.empty() {
+		return RootHints{}, step, fmt.Errorf("root priming response from %s has no root server addresses", best.server)
+	}
+	return primed, step, nil
+}
+
+// compareRootHints lists root servers that were added, removed or renumbered
+// between the configured hints and a priming answer.
+func compareRootHints(hints, primed RootHints) []string {
+	configured := addressesByName(hints)
+	live := addressesByName(primed)
+
+	warnings := []string{}
+	for _, name := range sortedKeys(live) {
+		if name == "" {
+			continue
+		}
+		want, ok := configured[name]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("root server %s is missing from the root hints", name))
+			continue
+		}
+		if strings.Join(want, ",") != strings.Join(live[name], ",") {
+			warnings = append(warnings, fmt.Sprintf("root hints are stale for %s: hints have %s, priming returned %s", name, strings.Join(want, " "), strings.Join(live[name], " ")))
+		}
+	}
+	for _, name := range sortedKeys(configured) {
+		if _, ok := live[name]; !ok && name != "" {
+			warnings = append(warnings, fmt.Sprintf("root hint %s is no longer in the root NS set", name))
+		}
+	}
+	liveAddrs := map[string]bool{}
+	for _, addrs := range live {
+		for _, addr := range addrs {
+			liveAddrs[addr] = true
+		}
+	}
+	for _, addr := range configured[""] {
+		if !liveAddrs[addr] {
+			warnings = append(warnings, fmt.Sprintf("root hint %s is not in the priming response", addr))
+		}
+	}
+	return warnings
+}
+
+func addressesByName(hints RootHints) map[string][]string {
+	out := map[string][]string{}
+	for _, addr := range append(append([]string{}, hints.IPv4...), hints.IPv6...) {
+		name := strings.ToLower(strings.TrimSuffix(hints.Names[addr], "."))
+		out[name] = append(out[name], addr)
+	}
+	for name := range out {
+		sort.Strings(out[name])
+	}
+	return out
+}
+
+func sortedKeys(values map[string][]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
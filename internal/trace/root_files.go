@@ -0,0 +1,172 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootHints is a set of root server addresses along with the server name for
+// each address.
+type RootHints struct {
+	IPv4  []string
+	IPv6  []string
+	Names map[string]string
+}
+
+func (h RootHints) empty() bool {
+	return len(h.IPv4) == 0 && len(h.IPv6) == 0
+}
+
+// LoadRootHints reads root server addresses from a zone-format hints file
+// such as named.root.
+func LoadRootHints(path string) (RootHints, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RootHints{}, fmt.Errorf("read root hints: %w", err)
+	}
+	parser := dns.NewZoneParser(bytes.NewReader(data), ".", path)
+	records := []dns.RR{}
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		records = append(records, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return RootHints{}, fmt.Errorf("parse root hints: %w", err)
+	}
+	hints := rootHintsFromRecords(records)
+	if hints.empty() {
+		return RootHints{}, fmt.Errorf("no root server addresses found in %s", path)
+	}
+	return hints, nil
+}
+
+// rootHintsFromRecords collects addresses for the NS names of the root zone,
+// ordered by server name.
+func rootHintsFromRecords(records []dns.RR) RootHints {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, rr := range records {
+		ns, ok := rr.(*dns.NS)
+		if !ok || ns.Hdr.Name != "." {
+			continue
+		}
+		name := strings.ToLower(dns.Fqdn(ns.Ns))
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	hints := RootHints{Names: map[string]string{}}
+	for _, name := range names {
+		label := strings.TrimSuffix(name, ".")
+		for _, rr := range records {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			switch record := rr.(type) {
+			case *dns.A:
+				addr := net.JoinHostPort(record.A.String(), "53")
+				hints.IPv4 = append(hints.IPv4, addr)
+				hints.Names[addr] = label
+			case *dns.AAAA:
+				addr := net.JoinHostPort(record.AAAA.String(), "53")
+				hints.IPv6 = append(hints.IPv6, addr)
+				hints.Names[addr] = label
+			}
+		}
+	}
+	hints.IPv4 = uniqueStrings(hints.IPv4)
+	hints.IPv6 = uniqueStrings(hints.IPv6)
+	return hints
+}
+
+type trustAnchorXML struct {
+	Zone    string `xml:"Zone"`
+	Digests []struct {
+		ValidFrom  string `xml:"validFrom,attr"`
+		ValidUntil string `xml:"validUntil,attr"`
+		KeyTag     uint16 `xml:"KeyTag"`
+		Algorithm  uint8  `xml:"Algorithm"`
+		DigestType uint8  `xml:"DigestType"`
+		Digest     string `xml:"Digest"`
+	} `xml:"KeyDigest"`
+}
+
+// LoadTrustAnchors reads root trust anchors from an IANA root-anchors.xml
+// file or from a zone-format file of DS or DNSKEY records such as root.key.
+// DNSKEY anchors are converted to SHA-256 DS records.
+func LoadTrustAnchors(path string) ([]*dns.DS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read trust anchors: %w", err)
+	}
+	var anchors []*dns.DS
+	if bytes.Contains(data, []byte("<TrustAnchor")) {
+		anchors, err = parseTrustAnchorXML(data, time.Now())
+	} else {
+		anchors, err = parseTrustAnchorZone(data, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no usable trust anchors found in %s", path)
+	}
+	return anchors, nil
+}
+
+func parseTrustAnchorXML(data []byte, now time.Time) ([]*dns.DS, error) {
+	doc := trustAnchorXML{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse trust anchors: %w", err)
+	}
+	zone := dns.Fqdn(strings.TrimSpace(doc.Zone))
+	anchors := []*dns.DS{}
+	for _, digest := range doc.Digests {
+		if from, err := time.Parse(time.RFC3339, digest.ValidFrom); err == nil && now.Before(from) {
+			continue
+		}
+		if until, err := time.Parse(time.RFC3339, digest.ValidUntil); err == nil && now.After(until) {
+			continue
+		}
+		anchors = append(anchors, &dns.DS{
+			Hdr:        dns.RR_Header{Name: zone, Rrtype: dns.TypeDS, Class: dns.ClassINET},
+			KeyTag:     digest.KeyTag,
+			Algorithm:  digest.Algorithm,
+			DigestType: digest.DigestType,
+			Digest:     strings.ToUpper(strings.TrimSpace(digest.Digest)),
+		})
+	}
+	return anchors, nil
+}
+
+func parseTrustAnchorZone(data []byte, path string) ([]*dns.DS, error) {
+	parser := dns.NewZoneParser(bytes.NewReader(data), ".", path)
+	anchors := []*dns.DS{}
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch record := rr.(type) {
+		case *dns.DS:
+			anchors = append(anchors, record)
+		case *dns.DNSKEY:
+			if record.Flags&dns.REVOKE != 0 || record.Flags&dns.SEP == 0 {
+				continue
+			}
+			if ds := record.ToDS(dns.SHA256); ds != nil {
+				anchors = append(anchors, ds)
+			}
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("parse trust anchors: %w", err)
+	}
+	return anchors, nil
+}
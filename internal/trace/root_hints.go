@@ -16,6 +16,22 @@ var DefaultRootHints = []string{
 	"202.12.27.33:53",   // m.root-servers.net
 }
 
+var DefaultRootHints6 = []string{
+	"[2001:503:ba3e::2:30]:53", // a.root-servers.net
+	"[2801:1b8:10::b]:53",      // b.root-servers.net
+	"[2001:500:2::c]:53",       // c.root-servers.net
+	"[2001:500:2d::d]:53",      // d.root-servers.net
+	"[2001:500:a8::e]:53",      // e.root-servers.net
+	"[2001:500:2f::f]:53",      // f.root-servers.net
+	"[2001:500:12::d0d]:53",    // g.root-servers.net
+	"[2001:500:1::53]:53",      // h.root-servers.net
+	"[2001:7fe::53]:53",        // i.root-servers.net
+	"[2001:503:c27::2:30]:53",  // j.root-servers.net
+	"[2001:7fd::1]:53",         // k.root-servers.net
+	"[2001:500:9f::42]:53",     // l.root-servers.net
+	"[2001:dc3::35]:53",        // m.root-servers.net
+}
+
 var DefaultRootHintNames = map[string]string{
 	"198.41.0.4:53":     "a.root-servers.net",
 	"199.9.14.201:53":   "b.root-servers.net",
@@ -30,4 +46,18 @@ var DefaultRootHintNames = map[string]string{
 	"193.0.14.129:53":   "k.root-servers.net",
 	"199.7.83.42:53":    "l.root-servers.net",
 	"202.12.27.33:53":   "m.root-servers.net",
+
+	"[2001:503:ba3e::2:30]:53": "a.root-servers.net",
+	"[2801:1b8:10::b]:53":      "b.root-servers.net",
+	"[2001:500:2::c]:53":       "c.root-servers.net",
+	"[2001:500:2d::d]:53":      "d.root-servers.net",
+	"[2001:500:a8::e]:53":      "e.root-servers.net",
+	"[2001:500:2f::f]:53":      "f.root-servers.net",
+	"[2001:500:12::d0d]:53":    "g.root-servers.net",
+	"[2001:500:1::53]:53":      "h.root-servers.net",
+	"[2001:7fe::53]:53":        "i.root-servers.net",
+	"[2001:503:c27::2:30]:53":  "j.root-servers.net",
+	"[2001:7fd::1]:53":         "k.root-servers.net",
+	"[2001:500:9f::42]:53":     "l.root-servers.net",
+	"[2001:dc3::35]:53":        "m.root-servers.net",
 }
@@ -0,0 +1,125 @@
+package trace
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jaxxstorm/dnstrace/internal/analyze"
+	"github.com/jaxxstorm/dnstrace/internal/model"
+	"github.com/miekg/dns"
+)
+
+const (
+	soaOK       = "ok"
+	soaBehind   = "behind"
+	soaMismatch = "mismatch"
+	soaError    = "error"
+)
+
+// checkSOA compares the serial, MNAME and timers each nameserver address
+// returned in the zone probe.
+func checkSOA(probe *zoneProbe) ([]model.SOACheck, []consistencyIssue) {
+	zone, labels, responses := probe.zone, probe.labels, probe.responses
+	if probe.failure != "" {
+		return nil, []consistencyIssue{{kind: analyze.OutcomeSOAMismatch, text: fmt.Sprintf("%s: %s", zone, probe.failure), step: probe.nsStep}}
+	}
+	issues := []consistencyIssue{}
+	for _, name := range probe.unresolved {
+		issues = append(issues, consistencyIssue{
+			kind: analyze.OutcomeSOAMismatch,
+			text: fmt.Sprintf("%s: could not resolve nameserver %s", zone, name),
+			step: probe.nsStep,
+		})
+	}
+
+	checks := make([]model.SOACheck, 0, len(responses))
+	var reference *model.SOACheck
+	for _, r := range responses {
+		check := model.SOACheck{
+			Server:     r.server,
+			ServerName: labels[r.server],
+			Family:     string(serverFamily(r.server)),
+			Step:       r.stepIndex,
+			Status:     soaOK,
+		}
+		soa := answerSOA(r, zone)
+		switch {
+		case r.err != nil:
+			check.Status = soaError
+			check.Error = r.err.Error()
+		case soa == nil:
+			check.Status = soaError
+			check.Error = "no authoritative SOA in answer"
+		default:
+			check.Serial = soa.Serial
+			check.MName = strings.ToLower(soa.Ns)
+			check.Refresh = soa.Refresh
+			check.Retry = soa.Retry
+			check.Expire = soa.Expire
+			check.Minimum = soa.Minttl
+		}
+		checks = append(checks, check)
+	}
+	for i := range checks {
+		if checks[i].Status == soaOK && (reference == nil || serialNewer(checks[i].Serial, reference.Serial)) {
+			reference = &checks[i]
+		}
+	}
+
+	for i := range checks {
+		check := &checks[i]
+		server := serverName(check.Server, labels)
+		switch {
+		case check.Status == soaError:
+			issues = append(issues, consistencyIssue{
+				kind: analyze.OutcomeSOAMismatch,
+				text: fmt.Sprintf("%s: %s returned no SOA: %s", zone, server, check.Error),
+				step: check.Step,
+			})
+		case serialNewer(reference.Serial, check.Serial):
+			check.Status = soaBehind
+			issues = append(issues, consistencyIssue{
+				kind: analyze.OutcomeStaleSecondary,
+				text: fmt.Sprintf("%s: %s serves serial %d, behind %d on %s", zone, server, check.Serial, reference.Serial, serverName(reference.Server, labels)),
+				step: check.Step,
+			})
+		case check.MName != reference.MName:
+			check.Status = soaMismatch
+			issues = append(issues, consistencyIssue{
+				kind: analyze.OutcomeSOAMismatch,
+				text: fmt.Sprintf("%s: %s has MNAME %s, %s has %s", zone, server, check.MName, serverName(reference.Server, labels), reference.MName),
+				step: check.Step,
+			})
+		case soaTimers(*check) != soaTimers(*reference):
+			check.Status = soaMismatch
+			issues = append(issues, consistencyIssue{
+				kind: analyze.OutcomeSOAMismatch,
+				text: fmt.Sprintf("%s: %s has timers %s, %s has %s", zone, server, soaTimers(*check), serverName(reference.Server, labels), soaTimers(*reference)),
+				step: check.Step,
+			})
+		}
+	}
+	return checks, issues
+}
+
+// answerSOA returns the authoritative SOA for zone from the answer section.
+func answerSOA(r response, zone string) *dns.SOA {
+	if r.err != nil || r.resp == nil || !r.resp.Authoritative || r.resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	for _, rr := range r.resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, zone) {
+			return soa
+		}
+	}
+	return nil
+}
+
+// serialNewer compares serials with RFC 1982 sequence space arithmetic.
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+func soaTimers(check model.SOACheck) string {
+	return fmt.Sprintf("refresh=%d retry=%d expire=%d minimum=%d", check.Refresh, check.Retry, check.Expire, check.Minimum)
+}
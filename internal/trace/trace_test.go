@@ -2,12 +2,20 @@ package trace
 
 import (
 	"context"
+	"crypto"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/jaxxstorm/dnstrace/internal/dnsclient"
+	"github.com/jaxxstorm/dnstrace/internal/model"
 	"github.com/miekg/dns"
 )
 
@@ -102,3 +110,1725 @@ func TestTraceFollowsCNAME(t *testing.T) {
 		t.Fatalf("expected SUCCESS, got %s", result.Diagnosis.Classification)
 	}
 }
+
+func TestTraceRecordsNSID(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		resp.Authoritative = true
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		opt := msg.IsEdns0()
+		if opt == nil {
+			return resp, time.Millisecond, nil
+		}
+		for _, option := range opt.Option {
+			if option.Option() == dns.EDNS0NSID {
+				resp.SetEdns0(1232, false)
+				resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte("ams1.root"))}}
+			}
+		}
+		return resp, time.Millisecond, nil
+	}}
+
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second, NSID: true}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 2})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if len(result.TraceSteps) == 0 || result.TraceSteps[0].NSID != "ams1.root" {
+		t.Fatalf("expected nsid on step, got %#v", result.TraceSteps)
+	}
+}
+
+func TestTraceReportsCookieSupportPerServer(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.com."}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+			var sent string
+			for _, option := range msg.IsEdns0().Option {
+				if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+					sent = cookie.Cookie
+				}
+			}
+			resp.SetEdns0(1232, false)
+			resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: sent[:16] + "0102030405060708"}}
+		case "192.0.2.1:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		}
+		return resp, time.Millisecond, nil
+	}}
+
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second, Cookies: true}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 2})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	statuses := map[string]string{}
+	for _, check := range result.Cookies {
+		statuses[check.Server] = check.Status
+	}
+	if statuses["1.1.1.1:53"] != dnsclient.CookieSupported || statuses["192.0.2.1:53"] != dnsclient.CookieIgnored {
+		t.Fatalf("unexpected cookie report: %#v", result.Cookies)
+	}
+}
+
+func dualStackResponder(v6Broken bool) func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch server {
+		case "1.1.1.1:53", "[2001:db8::1]:53":
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."}}
+			resp.Extra = []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")},
+				&dns.AAAA{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::53")},
+			}
+			return resp, time.Millisecond, nil
+		case "192.0.2.53:53", "[2001:db8::53]:53":
+			if server == "[2001:db8::53]:53" && v6Broken {
+				return nil, 0, context.DeadlineExceeded
+			}
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+			return resp, time.Millisecond, nil
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+	}
+}
+
+func TestTraceIPv6OnlyUsesIPv6Servers(t *testing.T) {
+	queried := map[string]bool{}
+	responder := dualStackResponder(false)
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		queried[server] = true
+		return responder(server, msg)
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv6})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+	tracer.rootHints6 = []string{"[2001:db8::1]:53"}
+
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "SUCCESS" {
+		t.Fatalf("expected SUCCESS, got %s", result.Diagnosis.Classification)
+	}
+	for server := range queried {
+		if serverFamily(server) != FamilyIPv6 {
+			t.Fatalf("queried non-IPv6 server %s", server)
+		}
+	}
+}
+
+func TestTraceDualStackReportsFamilyOnlyFailure(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: dualStackResponder(true)}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 2})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+	tracer.rootHints6 = []string{"[2001:db8::1]:53"}
+
+	result, err := tracer.TraceDualStack(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "ADDRESS_FAMILY_MISMATCH" {
+		t.Fatalf("expected ADDRESS_FAMILY_MISMATCH, got %s", result.Diagnosis.Classification)
+	}
+	found := false
+	for _, hint := range result.Diagnosis.Hints {
+		if hint == "zone example.com. reached over IPv4 only" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected example.com. family hint, got %#v", result.Diagnosis.Hints)
+	}
+	for _, step := range result.TraceSteps {
+		if step.Family == "" {
+			t.Fatalf("expected family on every step: %#v", step)
+		}
+	}
+}
+
+func TestTraceDualStackResolvesNameserversPerFamily(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		referral := func(zone, host, v4, v6 string) {
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: host}}
+			if v4 != "" {
+				resp.Extra = []dns.RR{
+					&dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(v4)},
+					&dns.AAAA{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 3600}, AAAA: net.ParseIP(v6)},
+				}
+			}
+		}
+		switch server {
+		case "1.1.1.1:53", "[2001:db8::1]:53":
+			switch {
+			case strings.HasSuffix(q.Name, ".com."):
+				referral("com.", "a.com.", "192.0.2.1", "2001:db8::2:1")
+			case server == "[2001:db8::1]:53":
+				resp.Rcode = dns.RcodeRefused
+			default:
+				referral("net.", "a.net.", "192.0.2.2", "2001:db8::2:2")
+			}
+		case "192.0.2.1:53", "[2001:db8::2:1]:53":
+			referral("example.com.", "ns1.dns.net.", "", "")
+		case "192.0.2.2:53", "[2001:db8::2:2]:53":
+			resp.Authoritative = true
+			switch q.Qtype {
+			case dns.TypeA:
+				resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.53")}}
+			case dns.TypeAAAA:
+				resp.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300}, AAAA: net.ParseIP("2001:db8::53")}}
+			}
+		case "192.0.2.53:53", "[2001:db8::53]:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+	tracer.rootHints6 = []string{"[2001:db8::1]:53"}
+
+	result, err := tracer.TraceDualStack(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "ADDRESS_FAMILY_MISMATCH" {
+		t.Fatalf("expected ADDRESS_FAMILY_MISMATCH, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	for _, step := range subTraceSteps(result.SubTraces) {
+		if step.Cached {
+			t.Fatalf("expected the IPv6 pass to look nameservers up itself, got cached step %#v", step)
+		}
+	}
+}
+
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600}, Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatalf("sign %s: %v", rrs[0].Header().Name, err)
+	}
+	return append(append([]dns.RR{}, rrs...), sig)
+}
+
+func (z *testZone) soa() *dns.SOA {
+	return &dns.SOA{Hdr: dns.RR_Header{Name: z.name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1." + z.name, Mbox: "hostmaster." + z.name, Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 60}
+}
+
+type signedOptions struct {
+	unsignedChild bool
+	tamperAnswer  bool
+	// nxdomain makes example.com. deny every A query with these records.
+	nxdomain []dns.RR
+}
+
+// signedResponder serves a signed root, com. and example.com. hierarchy from
+// 1.1.1.1, 192.0.2.1 and 192.0.2.53.
+func signedResponder(t *testing.T, root, com, example *testZone, opts signedOptions) func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch server {
+		case "1.1.1.1:53":
+			switch {
+			case q.Qtype == dns.TypeDNSKEY:
+				resp.Authoritative = true
+				resp.Answer = root.sign(t, root.key)
+			case q.Qtype == dns.TypeDS && q.Name == "com.":
+				resp.Authoritative = true
+				resp.Answer = root.sign(t, com.key.ToDS(dns.SHA256))
+			default:
+				resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.com."}}
+				resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+			}
+		case "192.0.2.1:53":
+			switch {
+			case q.Qtype == dns.TypeDNSKEY:
+				resp.Authoritative = true
+				resp.Answer = com.sign(t, com.key)
+			case q.Qtype == dns.TypeDS && q.Name == "example.com." && opts.unsignedChild:
+				resp.Authoritative = true
+				nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60}, NextDomain: "zzz.com.", TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}}
+				resp.Ns = append(com.sign(t, com.soa()), com.sign(t, nsec)...)
+			case q.Qtype == dns.TypeDS && q.Name == "example.com.":
+				resp.Authoritative = true
+				resp.Answer = com.sign(t, example.key.ToDS(dns.SHA256))
+			default:
+				resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."}}
+				resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")}}
+			}
+		case "192.0.2.53:53":
+			resp.Authoritative = true
+			switch q.Qtype {
+			case dns.TypeDNSKEY:
+				resp.Answer = example.sign(t, example.key)
+			case dns.TypeA:
+				if opts.nxdomain != nil {
+					resp.Rcode = dns.RcodeNameError
+					resp.Ns = example.sign(t, example.soa())
+					for _, rr := range opts.nxdomain {
+						resp.Ns = append(resp.Ns, example.sign(t, rr)...)
+					}
+					break
+				}
+				a := &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}
+				resp.Answer = example.sign(t, a)
+				if opts.tamperAnswer {
+					a.A = net.ParseIP("198.51.100.66")
+				}
+			}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}
+}
+
+func TestTraceValidatesDNSSECChain(t *testing.T) {
+	root := newTestZone(t, ".")
+	com := newTestZone(t, "com.")
+	example := newTestZone(t, "example.com.")
+
+	cases := []struct {
+		name   string
+		opts   signedOptions
+		expect string
+	}{
+		{name: "secure", expect: "SUCCESS"},
+		{name: "tampered answer", opts: signedOptions{tamperAnswer: true}, expect: "DNSSEC_BOGUS"},
+		{name: "unsigned child", opts: signedOptions{unsignedChild: true}, expect: "DNSSEC_INSECURE"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &dnsclient.MockTransport{Responder: signedResponder(t, root, com, example, tc.opts)}
+			client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+			tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, DNSSEC: true})
+			tracer.rootHints = []string{"1.1.1.1:53"}
+			tracer.trustAnchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+
+			result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+			if err != nil {
+				t.Fatalf("trace error: %v", err)
+			}
+			if result.Diagnosis.Classification != tc.expect {
+				t.Fatalf("expected %s, got %s: %s", tc.expect, result.Diagnosis.Classification, result.Diagnosis.Summary)
+			}
+			if len(result.Diagnosis.EvidenceSteps) == 0 {
+				t.Fatalf("expected evidence steps")
+			}
+			last := result.TraceSteps[len(result.TraceSteps)-1]
+			if last.DNSSEC == "" {
+				t.Fatalf("expected dnssec status on final step: %#v", last)
+			}
+		})
+	}
+}
+
+func TestTraceDNSSECLiteralWildcardQuery(t *testing.T) {
+	root := newTestZone(t, ".")
+	com := newTestZone(t, "com.")
+	example := newTestZone(t, "example.com.")
+	transport := &dnsclient.MockTransport{Responder: signedResponder(t, root, com, example, signedOptions{})}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, DNSSEC: true})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+	tracer.trustAnchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+
+	result, err := tracer.Trace(context.Background(), "*.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "SUCCESS" {
+		t.Fatalf("expected SUCCESS, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	last := result.TraceSteps[len(result.TraceSteps)-1]
+	if last.DNSSEC != "secure" {
+		t.Fatalf("expected secure final step, got %q", last.DNSSEC)
+	}
+}
+
+func TestTraceDNSSECUntrustedRootKey(t *testing.T) {
+	root := newTestZone(t, ".")
+	other := newTestZone(t, ".")
+	transport := &dnsclient.MockTransport{Responder: signedResponder(t, root, newTestZone(t, "com."), newTestZone(t, "example.com."), signedOptions{})}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, DNSSEC: true})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+	tracer.trustAnchors = []*dns.DS{other.key.ToDS(dns.SHA256)}
+
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "DNSSEC_BOGUS" {
+		t.Fatalf("expected DNSSEC_BOGUS, got %s", result.Diagnosis.Classification)
+	}
+	if result.Diagnosis.EvidenceSteps[0] != 0 || result.TraceSteps[0].QueryType != "DNSKEY" {
+		t.Fatalf("expected root DNSKEY step as evidence, got %v", result.Diagnosis.EvidenceSteps)
+	}
+}
+
+func TestTraceChecksAuthenticatedDenial(t *testing.T) {
+	root := newTestZone(t, ".")
+	com := newTestZone(t, "com.")
+	example := newTestZone(t, "example.com.")
+
+	nsec := func(owner, next string) dns.RR {
+		return &dns.NSEC{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60}, NextDomain: next, TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}}
+	}
+	nsec3 := func(ownerHash, next string, iterations uint16, types ...uint16) dns.RR {
+		return &dns.NSEC3{Hdr: dns.RR_Header{Name: ownerHash + ".example.com.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 60}, Hash: dns.SHA1, Iterations: iterations, SaltLength: 0, HashLength: 20, NextDomain: next, TypeBitMap: types}
+	}
+	apexHash := func(iterations uint16) string {
+		return dns.HashName("example.com.", dns.SHA1, iterations, "")
+	}
+	low := strings.Repeat("0", 32)
+	high := strings.Repeat("V", 32)
+
+	cases := []struct {
+		name   string
+		denial []dns.RR
+		expect string
+		hints  []string
+	}{
+		{name: "nsec proof", denial: []dns.RR{nsec("example.com.", "www.example.com.")}, expect: "NXDOMAIN"},
+		{name: "nsec missing wildcard", denial: []dns.RR{nsec("a.example.com.", "www.example.com.")}, expect: "DNSSEC_BAD_DENIAL"},
+		{name: "nsec3 proof", denial: []dns.RR{nsec3(apexHash(0), high, 0, dns.TypeSOA, dns.TypeNS), nsec3(low, high, 0, dns.TypeA)}, expect: "NXDOMAIN"},
+		{name: "nsec3 no next closer", denial: []dns.RR{nsec3(apexHash(0), high, 0, dns.TypeSOA, dns.TypeNS)}, expect: "DNSSEC_BAD_DENIAL"},
+		{name: "nsec3 iterations", denial: []dns.RR{nsec3(apexHash(500), high, 500, dns.TypeSOA, dns.TypeNS), nsec3(low, high, 500, dns.TypeA)}, expect: "NXDOMAIN", hints: []string{"NSEC3 uses 500 iterations; RFC 9276 recommends 0", "DNSSEC insecure below example.com.: NSEC3 iterations exceed the validator limit of 150: 500"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &dnsclient.MockTransport{Responder: signedResponder(t, root, com, example, signedOptions{nxdomain: tc.denial})}
+			client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+			tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, DNSSEC: true})
+			tracer.rootHints = []string{"1.1.1.1:53"}
+			tracer.trustAnchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+
+			result, err := tracer.Trace(context.Background(), "missing.example.com", "A")
+			if err != nil {
+				t.Fatalf("trace error: %v", err)
+			}
+			if result.Diagnosis.Classification != tc.expect {
+				t.Fatalf("expected %s, got %s: %s", tc.expect, result.Diagnosis.Classification, result.Diagnosis.Summary)
+			}
+			if tc.expect == "DNSSEC_BAD_DENIAL" && len(result.Diagnosis.Records) == 0 {
+				t.Fatalf("expected offending records in diagnosis")
+			}
+			hints := strings.Join(result.Diagnosis.Hints, "\n")
+			for _, want := range tc.hints {
+				if !strings.Contains(hints, want) {
+					t.Fatalf("expected hint %q, got %#v", want, result.Diagnosis.Hints)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthFlagsExpiringSignatures(t *testing.T) {
+	root := newTestZone(t, ".")
+	com := newTestZone(t, "com.")
+	example := newTestZone(t, "example.com.")
+	responder := signedResponder(t, root, com, example, signedOptions{})
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		if server == "192.0.2.53:53" && msg.Question[0].Qtype == dns.TypeSOA {
+			resp := new(dns.Msg)
+			resp.SetReply(msg)
+			resp.Authoritative = true
+			resp.Answer = example.sign(t, example.soa())
+			return resp, time.Millisecond, nil
+		}
+		return responder(server, msg)
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+	tracer.trustAnchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+
+	report, err := tracer.Health(context.Background(), "example.com", 0)
+	if err != nil {
+		t.Fatalf("health error: %v", err)
+	}
+	if report.Diagnosis.Classification != "SUCCESS" {
+		t.Fatalf("expected SUCCESS, got %s: %s", report.Diagnosis.Classification, report.Diagnosis.Summary)
+	}
+	if len(report.Zones) != 3 {
+		t.Fatalf("expected 3 zone cuts, got %d", len(report.Zones))
+	}
+	leaf := report.Zones[2]
+	if leaf.Zone != "example.com." || len(leaf.DS) != 1 || !leaf.DS[0].ActiveKSK || len(leaf.Keys) != 1 || leaf.Keys[0].Role != "KSK" {
+		t.Fatalf("unexpected leaf health: %#v", leaf)
+	}
+
+	report, err = tracer.Health(context.Background(), "example.com", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("health error: %v", err)
+	}
+	if report.Diagnosis.Classification != "DNSSEC_EXPIRING" {
+		t.Fatalf("expected DNSSEC_EXPIRING, got %s", report.Diagnosis.Classification)
+	}
+}
+
+func TestLoadRootHintsAndTrustAnchors(t *testing.T) {
+	dir := t.TempDir()
+	hintsFile := filepath.Join(dir, "named.root")
+	hints := `; lab root
+.                        3600000      NS    A.LAB-ROOT.
+A.LAB-ROOT.              3600000      A     10.0.0.1
+A.LAB-ROOT.              3600000      AAAA  fd00::1
+.                        3600000      NS    B.LAB-ROOT.
+B.LAB-ROOT.              3600000      A     10.0.0.2
+`
+	if err := os.WriteFile(hintsFile, []byte(hints), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := LoadRootHints(hintsFile)
+	if err != nil {
+		t.Fatalf("load root hints: %v", err)
+	}
+	if len(roots.IPv4) != 2 || roots.IPv4[0] != "10.0.0.1:53" || len(roots.IPv6) != 1 || roots.IPv6[0] != "[fd00::1]:53" {
+		t.Fatalf("unexpected hints: %#v", roots)
+	}
+	if roots.Names["10.0.0.2:53"] != "b.lab-root" {
+		t.Fatalf("unexpected names: %#v", roots.Names)
+	}
+
+	xmlFile := filepath.Join(dir, "root-anchors.xml")
+	anchorsXML := `<?xml version="1.0" encoding="UTF-8"?>
+<TrustAnchor id="test" source="test">
+<Zone>.</Zone>
+<KeyDigest id="Klajeyz" validFrom="2010-07-15T00:00:00+00:00" validUntil="2019-01-11T00:00:00+00:00">
+<KeyTag>19036</KeyTag><Algorithm>8</Algorithm><DigestType>2</DigestType>
+<Digest>49AAC11D7B6F6446702E54A1607371607A1A41855200FD2CE1CDDE32F24E8FB5</Digest>
+</KeyDigest>
+<KeyDigest id="Kjqmt7v" validFrom="2017-02-02T00:00:00+00:00">
+<KeyTag>20326</KeyTag><Algorithm>8</Algorithm><DigestType>2</DigestType>
+<Digest>E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D</Digest>
+</KeyDigest>
+</TrustAnchor>
+`
+	if err := os.WriteFile(xmlFile, []byte(anchorsXML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	anchors, err := LoadTrustAnchors(xmlFile)
+	if err != nil {
+		t.Fatalf("load xml anchors: %v", err)
+	}
+	if len(anchors) != 1 || anchors[0].KeyTag != 20326 {
+		t.Fatalf("expected only the current anchor, got %#v", anchors)
+	}
+
+	root := newTestZone(t, ".")
+	keyFile := filepath.Join(dir, "root.key")
+	if err := os.WriteFile(keyFile, []byte(root.key.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	anchors, err = LoadTrustAnchors(keyFile)
+	if err != nil {
+		t.Fatalf("load key anchors: %v", err)
+	}
+	if len(anchors) != 1 || anchors[0].KeyTag != root.key.KeyTag() || anchors[0].DigestType != dns.SHA256 {
+		t.Fatalf("unexpected anchors from root.key: %#v", anchors)
+	}
+}
+
+func TestTracePrimingWarnsOnStaleHints(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		resp.Authoritative = true
+		switch {
+		case q.Name == "." && q.Qtype == dns.TypeNS:
+			resp.Answer = []dns.RR{
+				&dns.NS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 518400}, Ns: "a.lab-root."},
+				&dns.NS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 518400}, Ns: "b.lab-root."},
+			}
+			resp.Extra = []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: "a.lab-root.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 518400}, A: net.ParseIP("10.0.0.1")},
+				&dns.A{Hdr: dns.RR_Header{Name: "b.lab-root.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 518400}, A: net.ParseIP("10.0.0.9")},
+			}
+		case server == "10.0.0.9:53" || server == "10.0.0.1:53":
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	hints := RootHints{
+		IPv4:  []string{"10.0.0.1:53", "10.0.0.2:53"},
+		Names: map[string]string{"10.0.0.1:53": "a.lab-root", "10.0.0.2:53": "b.lab-root"},
+	}
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, RootHints: hints, Prime: true})
+
+	result, err := tracer.Trace(context.Background(), "example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "SUCCESS" {
+		t.Fatalf("expected SUCCESS, got %s", result.Diagnosis.Classification)
+	}
+	if first := result.TraceSteps[0]; first.QueryName != "." || first.QueryType != "NS" || !strings.Contains(first.Note, "priming") {
+		t.Fatalf("expected priming step first, got %#v", first)
+	}
+	want := "root hints are stale for b.lab-root: hints have 10.0.0.2:53, priming returned 10.0.0.9:53"
+	if len(result.Diagnosis.Warnings) != 1 || result.Diagnosis.Warnings[0] != want {
+		t.Fatalf("unexpected warnings: %#v", result.Diagnosis.Warnings)
+	}
+
+	// Later traces still compare against the configured hints.
+	result, err = tracer.Trace(context.Background(), "example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if len(result.Diagnosis.Warnings) != 1 || result.Diagnosis.Warnings[0] != want {
+		t.Fatalf("expected the stale hint warning again, got %#v", result.Diagnosis.Warnings)
+	}
+}
+
+func TestTracePrimingReplacesRootHints(t *testing.T) {
+	authoritative := true
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch {
+		case q.Name == "." && q.Qtype == dns.TypeNS:
+			resp.Authoritative = authoritative
+			resp.Answer = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 518400}, Ns: "a.lab-root."}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.lab-root.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 518400}, A: net.ParseIP("10.0.0.9")}}
+		case server == "10.0.0.9:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			resp.Rcode = dns.RcodeRefused
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, Prime: true, RootHints: RootHints{IPv4: []string{"10.0.0.1:53"}}})
+
+	authoritative = false
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	want := "root priming response from 10.0.0.1:53 is not an authoritative root NS set; using configured root hints"
+	if len(result.Diagnosis.Warnings) != 1 || result.Diagnosis.Warnings[0] != want {
+		t.Fatalf("expected the non-authoritative priming answer to be rejected, got %#v", result.Diagnosis.Warnings)
+	}
+	if last := result.TraceSteps[len(result.TraceSteps)-1]; last.Server != "10.0.0.1:53" {
+		t.Fatalf("expected the configured hints to be queried, got %s", last.Server)
+	}
+
+	authoritative = true
+	result, err = tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "SUCCESS" {
+		t.Fatalf("expected SUCCESS from the primed root, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	if last := result.TraceSteps[len(result.TraceSteps)-1]; last.Server != "10.0.0.9:53" || last.ServerName != "a.lab-root" {
+		t.Fatalf("expected the primed root to answer, got %s (%s)", last.Server, last.ServerName)
+	}
+}
+
+func TestTraceQNameMinimisation(t *testing.T) {
+	cases := []struct {
+		name       string
+		brokenENT  bool
+		wantClass  string
+		wantQNames []string
+	}{
+		{name: "empty non-terminal", wantClass: "SUCCESS", wantQNames: []string{"com.", "example.com.", "lab.example.com.", "www.lab.example.com."}},
+		{name: "nxdomain on empty non-terminal", brokenENT: true, wantClass: "QNAME_MINIMISATION_FAILURE", wantQNames: []string{"com.", "example.com.", "lab.example.com.", "www.lab.example.com."}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+				q := msg.Question[0]
+				resp := new(dns.Msg)
+				resp.SetReply(msg)
+				switch server {
+				case "1.1.1.1:53":
+					resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.com."}}
+					resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+				case "192.0.2.1:53":
+					resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."}}
+					resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")}}
+				case "192.0.2.53:53":
+					resp.Authoritative = true
+					soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com.", Mbox: "hostmaster.example.com.", Serial: 1, Minttl: 60}
+					switch q.Name {
+					case "lab.example.com.":
+						if tc.brokenENT {
+							resp.Rcode = dns.RcodeNameError
+						}
+						resp.Ns = []dns.RR{soa, &dns.NSEC{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60}, NextDomain: "www.lab.example.com.", TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA}}}
+					case "www.lab.example.com.":
+						resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+					default:
+						return nil, 0, errors.New("unexpected qname " + q.Name)
+					}
+				default:
+					return nil, 0, errors.New("unexpected server " + server)
+				}
+				return resp, time.Millisecond, nil
+			}}
+			client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+			tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, QNameMin: true})
+			tracer.rootHints = []string{"1.1.1.1:53"}
+
+			result, err := tracer.Trace(context.Background(), "www.lab.example.com", "A")
+			if err != nil {
+				t.Fatalf("trace error: %v", err)
+			}
+			if result.Diagnosis.Classification != tc.wantClass {
+				t.Fatalf("expected %s, got %s: %s", tc.wantClass, result.Diagnosis.Classification, result.Diagnosis.Summary)
+			}
+			qnames := []string{}
+			for _, step := range result.TraceSteps {
+				qnames = append(qnames, step.QueryName)
+			}
+			if strings.Join(qnames, " ") != strings.Join(tc.wantQNames, " ") {
+				t.Fatalf("unexpected query names: %v", qnames)
+			}
+			ent := result.TraceSteps[2]
+			if ent.QueryType != "NS" {
+				t.Fatalf("expected minimised NS query, got %s", ent.QueryType)
+			}
+			wantNote := "qname-min ent"
+			if tc.brokenENT {
+				wantNote = "qname-min fallback"
+			}
+			if !strings.Contains(ent.Note, wantNote) {
+				t.Fatalf("expected note %q, got %q", wantNote, ent.Note)
+			}
+		})
+	}
+}
+
+func TestTraceAllPathsFlagsLameSibling(t *testing.T) {
+	example := []string{"192.0.2.53", "192.0.2.54", "192.0.2.55", "192.0.2.56"}
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.com."}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		case "192.0.2.1:53":
+			for i, addr := range example {
+				host := fmt.Sprintf("ns%d.example.com.", i+1)
+				resp.Ns = append(resp.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: host})
+				resp.Extra = append(resp.Extra, &dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(addr)})
+			}
+		case "192.0.2.56:53":
+			resp.Rcode = dns.RcodeRefused
+		case "192.0.2.53:53", "192.0.2.54:53", "192.0.2.55:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.TraceAllPaths(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "INCONSISTENT_NAMESERVERS" {
+		t.Fatalf("expected INCONSISTENT_NAMESERVERS, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	if result.Paths == nil || len(result.Paths.Servers) != 1 || result.Paths.Servers[0].Referral == nil {
+		t.Fatalf("expected root referral in tree, got %#v", result.Paths)
+	}
+	com := result.Paths.Servers[0].Referral
+	if com.Zone != "com." || len(com.Servers) != 1 || com.Servers[0].Referral == nil {
+		t.Fatalf("expected com. referral in tree, got %#v", com)
+	}
+	zone := com.Servers[0].Referral
+	if zone.Zone != "example.com." || len(zone.Servers) != len(example) {
+		t.Fatalf("expected every example.com. server in tree, got %#v", zone)
+	}
+	for _, server := range zone.Servers {
+		flagged := server.Issue != ""
+		if flagged != (server.Server == "192.0.2.56:53") {
+			t.Fatalf("unexpected issue for %s: %q", server.Server, server.Issue)
+		}
+	}
+	if len(result.Diagnosis.Hints) == 0 || !strings.Contains(result.Diagnosis.Hints[0], "ns4.example.com. (192.0.2.56:53) answered REFUSED") {
+		t.Fatalf("unexpected hints: %#v", result.Diagnosis.Hints)
+	}
+}
+
+func TestTraceFallbackRetriesGluelessDelegation(t *testing.T) {
+	responder := func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		delegate := func(glue bool) {
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."}}
+			if glue {
+				resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")}}
+			}
+		}
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{
+				&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.com."},
+				&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns2.com."},
+			}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		case "192.0.2.1:53":
+			switch q.Name {
+			case "ns1.com.":
+				resp.Authoritative = true
+				if q.Qtype == dns.TypeA {
+					resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+				}
+			case "ns2.com.":
+				resp.Authoritative = true
+				if q.Qtype == dns.TypeA {
+					resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.2")}}
+				}
+			default:
+				delegate(false)
+			}
+		case "192.0.2.2:53":
+			delegate(true)
+		case "192.0.2.53:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}
+	cases := []struct {
+		name     string
+		fallback bool
+		want     string
+	}{
+		{name: "stops at glue-less delegation", want: "BROKEN_DELEGATION"},
+		{name: "falls back", fallback: true, want: "SUCCESS"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &dnsclient.MockTransport{Responder: responder}
+			client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+			tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4, Fallback: tc.fallback})
+			tracer.rootHints = []string{"1.1.1.1:53"}
+
+			result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+			if err != nil {
+				t.Fatalf("trace error: %v", err)
+			}
+			if result.Diagnosis.Classification != tc.want {
+				t.Fatalf("expected %s, got %s: %s", tc.want, result.Diagnosis.Classification, result.Diagnosis.Summary)
+			}
+			if !tc.fallback {
+				return
+			}
+			want := "abandoned ns1.com. (192.0.2.1:53) for com.: delegation without glue"
+			if len(result.Diagnosis.Warnings) != 1 || result.Diagnosis.Warnings[0] != want {
+				t.Fatalf("unexpected warnings: %#v", result.Diagnosis.Warnings)
+			}
+		})
+	}
+}
+
+func TestTraceAllPathsFollowsDifferingGlue(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		referral := func(zone, host, addr string) {
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: host}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(addr)}}
+		}
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{}
+			for i, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+				host := fmt.Sprintf("ns%d.com.", i+1)
+				resp.Ns = append(resp.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: host})
+				resp.Extra = append(resp.Extra, &dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(addr)})
+			}
+		case "192.0.2.1:53", "192.0.2.2:53":
+			referral("example.com.", "ns1.example.com.", "192.0.2.53")
+		case "192.0.2.3:53":
+			referral("example.com.", "ns1.example.com.", "192.0.2.99")
+		case "192.0.2.99:53":
+			resp.Rcode = dns.RcodeRefused
+		case "192.0.2.53:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.TraceAllPaths(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Paths == nil || len(result.Paths.Servers) != 1 || result.Paths.Servers[0].Referral == nil {
+		t.Fatalf("expected root referral in tree, got %#v", result.Paths)
+	}
+	com := result.Paths.Servers[0].Referral
+	if len(com.Servers) != 3 {
+		t.Fatalf("expected every com. server in tree, got %#v", com)
+	}
+	for _, server := range com.Servers {
+		if flagged := server.Issue != ""; flagged != (server.Server == "192.0.2.3:53") {
+			t.Fatalf("unexpected issue for %s: %q", server.Server, server.Issue)
+		}
+	}
+	if com.Servers[0].Referral == nil || com.Servers[2].Referral == nil {
+		t.Fatalf("expected both distinct referrals to be followed, got %#v", com.Servers)
+	}
+	if !strings.Contains(com.Servers[2].Issue, "ns1.example.com.=192.0.2.99:53") {
+		t.Fatalf("expected the glue difference in the issue, got %q", com.Servers[2].Issue)
+	}
+	if referral := com.Servers[2].Referral; len(referral.Servers) != 1 || referral.Servers[0].Server != "192.0.2.99:53" {
+		t.Fatalf("expected the differing glue to be explored, got %#v", referral)
+	}
+}
+
+func TestTraceChecksDelegationConsistency(t *testing.T) {
+	nsRR := func(zone, host string) dns.RR {
+		return &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: host}
+	}
+	aRR := func(name, addr string) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(addr)}
+	}
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{nsRR("com.", "ns1.com.")}
+			resp.Extra = []dns.RR{aRR("ns1.com.", "192.0.2.1")}
+		case "192.0.2.1:53":
+			switch {
+			case q.Name == "com." && q.Qtype == dns.TypeNS:
+				resp.Authoritative = true
+				resp.Answer = []dns.RR{nsRR("com.", "ns1.com.")}
+			case q.Name == "ns1.com.":
+				resp.Authoritative = true
+				if q.Qtype == dns.TypeA {
+					resp.Answer = []dns.RR{aRR("ns1.com.", "192.0.2.1")}
+				}
+			default:
+				resp.Ns = []dns.RR{nsRR("example.com.", "ns1.example.com."), nsRR("example.com.", "ns2.example.com.")}
+				resp.Extra = []dns.RR{aRR("ns1.example.com.", "192.0.2.53"), aRR("ns2.example.com.", "192.0.2.54")}
+			}
+		case "192.0.2.53:53", "192.0.2.54:53":
+			resp.Authoritative = true
+			switch {
+			case q.Name == "example.com." && q.Qtype == dns.TypeNS:
+				resp.Answer = []dns.RR{nsRR("example.com.", "ns1.example.com."), nsRR("example.com.", "ns3.example.com.")}
+			case q.Name == "ns1.example.com." && q.Qtype == dns.TypeA:
+				resp.Answer = []dns.RR{aRR(q.Name, "192.0.2.99")}
+			case q.Name == "ns2.example.com." && q.Qtype == dns.TypeA:
+				resp.Answer = []dns.RR{aRR(q.Name, "192.0.2.54")}
+			case q.Qtype == dns.TypeA && q.Name == "www.example.com.":
+				resp.Answer = []dns.RR{aRR(q.Name, "203.0.113.10")}
+			}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, CheckDelegation: true})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "NS_MISMATCH" {
+		t.Fatalf("expected NS_MISMATCH, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	want := []string{
+		"example.com.: NS ns2.example.com. is in the parent delegation but not the child NS RRset",
+		"example.com.: NS ns3.example.com. is in the child NS RRset but not the parent delegation",
+		"example.com.: A glue for ns1.example.com. is 192.0.2.53 but the child has 192.0.2.99",
+	}
+	if len(result.Diagnosis.Hints) != len(want) {
+		t.Fatalf("unexpected hints: %#v", result.Diagnosis.Hints)
+	}
+	for i, hint := range want {
+		if result.Diagnosis.Hints[i] != hint {
+			t.Fatalf("hint %d: expected %q, got %q", i, hint, result.Diagnosis.Hints[i])
+		}
+	}
+}
+
+func TestTraceCheckSOAFlagsStaleSecondaries(t *testing.T) {
+	serials := map[string]uint32{"192.0.2.53:53": 2024060102, "[2001:db8::53]:53": 2024060101, "192.0.2.54:53": 2024060102}
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")}}
+			return resp, time.Millisecond, nil
+		case "192.0.2.53:53", "[2001:db8::53]:53", "192.0.2.54:53":
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		resp.Authoritative = true
+		switch {
+		case q.Qtype == dns.TypeSOA:
+			resp.Answer = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com.", Mbox: "hostmaster.example.com.", Serial: serials[server], Refresh: 7200, Retry: 3600, Expire: 1209600, Minttl: 300}}
+		case q.Qtype == dns.TypeNS && q.Name == "example.com.":
+			resp.Answer = []dns.RR{
+				&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."},
+				&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns2.example.com."},
+			}
+		case q.Qtype == dns.TypeA && q.Name == "ns1.example.com.":
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")}}
+		case q.Qtype == dns.TypeAAAA && q.Name == "ns1.example.com.":
+			resp.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::53")}}
+		case q.Qtype == dns.TypeA && q.Name == "ns2.example.com.":
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.54")}}
+		case q.Qtype == dns.TypeA && q.Name == "www.example.com.":
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, CheckSOA: true})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "STALE_SECONDARY" {
+		t.Fatalf("expected STALE_SECONDARY, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	if len(result.SOA) != 3 {
+		t.Fatalf("expected an SOA check per nameserver address, got %#v", result.SOA)
+	}
+	statuses := map[string]string{}
+	for _, check := range result.SOA {
+		statuses[check.Server] = check.Status
+	}
+	if statuses["192.0.2.53:53"] != "ok" || statuses["192.0.2.54:53"] != "ok" || statuses["[2001:db8::53]:53"] != "behind" {
+		t.Fatalf("unexpected statuses: %#v", statuses)
+	}
+	want := "example.com.: ns1.example.com. ([2001:db8::53]:53) serves serial 2024060101, behind 2024060102 on ns1.example.com. (192.0.2.53:53)"
+	if len(result.Diagnosis.Hints) != 1 || result.Diagnosis.Hints[0] != want {
+		t.Fatalf("unexpected hints: %#v", result.Diagnosis.Hints)
+	}
+}
+
+func TestTraceCheckLameClassifiesEveryNameserver(t *testing.T) {
+	hosts := map[string]string{"ns1.example.com.": "192.0.2.53", "ns2.example.com.": "192.0.2.54", "ns3.example.com.": "192.0.2.55"}
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		upward := func() {
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "a.root-servers.net."}}
+		}
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")}}
+			return resp, time.Millisecond, nil
+		case "192.0.2.54:53":
+			resp.Rcode = dns.RcodeRefused
+			return resp, time.Millisecond, nil
+		case "192.0.2.55:53":
+			upward()
+			return resp, time.Millisecond, nil
+		case "192.0.2.53:53":
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		resp.Authoritative = true
+		switch {
+		case q.Qtype == dns.TypeSOA:
+			resp.Answer = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com.", Mbox: "hostmaster.example.com.", Serial: 1}}
+		case q.Qtype == dns.TypeNS:
+			for _, host := range []string{"ns1.example.com.", "ns2.example.com.", "ns3.example.com.", "ns4.example.com."} {
+				resp.Answer = append(resp.Answer, &dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: host})
+			}
+		case q.Qtype == dns.TypeA && hosts[q.Name] != "":
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(hosts[q.Name])}}
+		case q.Qtype == dns.TypeA && q.Name == "www.example.com.":
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		case q.Name == "ns4.example.com.":
+			resp.Rcode = dns.RcodeNameError
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4, CheckLame: true})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "LAME_DELEGATION" {
+		t.Fatalf("expected LAME_DELEGATION, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	got := map[string]string{}
+	for _, check := range result.Nameservers {
+		got[check.ServerName] = check.Status + ": " + check.Detail
+		if check.Server != "" && result.TraceSteps[check.Step].Server != check.Server {
+			t.Fatalf("evidence step %d for %s is from %s", check.Step, check.Server, result.TraceSteps[check.Step].Server)
+		}
+	}
+	want := map[string]string{
+		"ns1.example.com.": "authoritative: SOA answered with AA set",
+		"ns2.example.com.": "lame: REFUSED",
+		"ns3.example.com.": "lame: referral upward to .",
+		"ns4.example.com.": "unreachable: no address records",
+	}
+	for name, status := range want {
+		if got[name] != status {
+			t.Fatalf("%s: expected %q, got %q", name, status, got[name])
+		}
+	}
+	if len(result.Diagnosis.Hints) != 3 {
+		t.Fatalf("expected a hint per lame nameserver, got %#v", result.Diagnosis.Hints)
+	}
+}
+
+func TestTraceFallbackTriesRemainingNameservers(t *testing.T) {
+	responder := func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.com."}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		case "192.0.2.1:53":
+			if q.Name == "ns2.example.net." {
+				resp.Authoritative = true
+				if q.Qtype == dns.TypeA {
+					resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.60")}}
+				}
+				break
+			}
+			resp.Ns = []dns.RR{
+				&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."},
+				&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns2.example.net."},
+			}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")}}
+		case "192.0.2.53:53":
+			resp.Rcode = dns.RcodeServerFailure
+		case "192.0.2.60:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}
+	cases := []struct {
+		name     string
+		fallback bool
+		want     string
+	}{
+		{name: "stops at first failure", want: "SERVFAIL_TIMEOUT"},
+		{name: "falls back", fallback: true, want: "SUCCESS"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &dnsclient.MockTransport{Responder: responder}
+			client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+			tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4, Fallback: tc.fallback})
+			tracer.rootHints = []string{"1.1.1.1:53"}
+
+			result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+			if err != nil {
+				t.Fatalf("trace error: %v", err)
+			}
+			if result.Diagnosis.Classification != tc.want {
+				t.Fatalf("expected %s, got %s: %s", tc.want, result.Diagnosis.Classification, result.Diagnosis.Summary)
+			}
+			if !tc.fallback {
+				return
+			}
+			abandoned := 0
+			for _, step := range result.TraceSteps {
+				if strings.Contains(step.Note, "abandoned") {
+					abandoned++
+					if step.Server != "192.0.2.53:53" {
+						t.Fatalf("unexpected abandoned server %s", step.Server)
+					}
+				}
+			}
+			if abandoned != 1 {
+				t.Fatalf("expected one abandoned step, got %d", abandoned)
+			}
+			want := "abandoned ns1.example.com. (192.0.2.53:53) for example.com.: SERVFAIL"
+			if len(result.Diagnosis.Warnings) != 1 || result.Diagnosis.Warnings[0] != want {
+				t.Fatalf("unexpected warnings: %#v", result.Diagnosis.Warnings)
+			}
+		})
+	}
+}
+
+func TestTraceCachesDelegationsAndAddresses(t *testing.T) {
+	queries := map[string]int{}
+	var mu sync.Mutex
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		mu.Lock()
+		queries[server]++
+		mu.Unlock()
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		ns := func(zone string, hosts ...string) {
+			for _, host := range hosts {
+				resp.Ns = append(resp.Ns, &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: host})
+			}
+		}
+		glue := func(host, addr string) {
+			resp.Extra = append(resp.Extra, &dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(addr)})
+		}
+		switch server {
+		case "1.1.1.1:53":
+			if strings.HasSuffix(q.Name, ".net.") {
+				ns("net.", "a.net.")
+				glue("a.net.", "192.0.2.2")
+			} else {
+				ns("com.", "a.com.")
+				glue("a.com.", "192.0.2.1")
+			}
+		case "192.0.2.1:53":
+			ns("example.com.", "ns1.dns.net.", "ns2.dns.net.")
+		case "192.0.2.2:53":
+			ns("dns.net.", "ns.dns.net.")
+			glue("ns.dns.net.", "192.0.2.3")
+		case "192.0.2.3:53":
+			resp.Authoritative = true
+			addr := map[string]string{"ns1.dns.net.": "192.0.2.53", "ns2.dns.net.": "192.0.2.54"}[q.Name]
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(addr)}}
+		case "192.0.2.53:53", "192.0.2.54:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4, Verbose: true})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "SUCCESS" {
+		t.Fatalf("expected SUCCESS, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	if queries["1.1.1.1:53"] != 2 || queries["192.0.2.2:53"] != 1 {
+		t.Fatalf("expected the second nameserver lookup to start at dns.net., got %v", queries)
+	}
+	cachedReferral := false
+	for _, step := range subTraceSteps(result.SubTraces) {
+		if step.Cached && strings.Contains(step.Note, "referral=dns.net.") {
+			cachedReferral = true
+		}
+	}
+	if !cachedReferral {
+		t.Fatalf("expected a cached referral step, got %#v", result.SubTraces)
+	}
+
+	result, err = tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if queries["1.1.1.1:53"] != 3 || queries["192.0.2.3:53"] != 2 {
+		t.Fatalf("expected cached nameserver addresses on the second trace, got %v", queries)
+	}
+	cachedAnswers := 0
+	for _, step := range subTraceSteps(result.SubTraces) {
+		if step.Cached && len(step.Answers) > 0 {
+			cachedAnswers++
+		}
+	}
+	if cachedAnswers != 2 {
+		t.Fatalf("expected two cached address steps, got %d", cachedAnswers)
+	}
+
+	lookup := model.TraceResult{}
+	cachedStep(&lookup, "ns1.dns.net.", dns.TypeA, "dns.net.", "192.0.2.3:53", nil, nil, nil, "")
+	if len(lookup.Timings) != 1 || lookup.Timings[0].StepIndex != 0 || lookup.Timings[0].Transport != "cache" {
+		t.Fatalf("expected a cache timing for the cached step, got %#v", lookup.Timings)
+	}
+}
+
+func TestTraceRecordsNameserverLookupsAsSubTraces(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		ns := func(zone, host string) {
+			resp.Ns = append(resp.Ns, &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: host})
+		}
+		answer := func(addr string) {
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(addr)}}
+		}
+		switch server {
+		case "1.1.1.1:53":
+			switch {
+			case strings.HasSuffix(q.Name, ".com."):
+				ns("com.", "a.gtld.")
+			case strings.HasSuffix(q.Name, ".net."):
+				ns("net.", "a.gtld.")
+			case strings.HasSuffix(q.Name, ".org."):
+				ns("org.", "a.gtld.")
+			}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.gtld.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP("192.0.2.1")}}
+		case "192.0.2.1:53":
+			switch {
+			case strings.HasSuffix(q.Name, "example.com."):
+				ns("example.com.", "ns1.dns.net.")
+			case strings.HasSuffix(q.Name, "dns.net."):
+				ns("dns.net.", "ns.dns.org.")
+			case q.Name == "ns.dns.org.":
+				answer("192.0.2.3")
+			}
+		case "192.0.2.3:53":
+			answer("192.0.2.53")
+		case "192.0.2.53:53":
+			answer("203.0.113.10")
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "SUCCESS" {
+		t.Fatalf("expected SUCCESS, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	if len(result.TraceSteps) != 3 {
+		t.Fatalf("expected nameserver lookups outside the main steps, got %d steps", len(result.TraceSteps))
+	}
+	if len(result.SubTraces) != 1 {
+		t.Fatalf("expected one sub-trace, got %#v", result.SubTraces)
+	}
+	sub := result.SubTraces[0]
+	if sub.ParentStep != 1 || sub.Name != "ns1.dns.net." || sub.QueryType != "A" {
+		t.Fatalf("unexpected sub-trace %+v", sub)
+	}
+	if len(sub.Addresses) != 1 || sub.Addresses[0] != "192.0.2.53:53" {
+		t.Fatalf("unexpected sub-trace addresses %v", sub.Addresses)
+	}
+	if len(sub.TraceSteps) != 3 {
+		t.Fatalf("expected the ns1.dns.net. lookup steps to be recorded, got %d", len(sub.TraceSteps))
+	}
+	if len(sub.SubTraces) != 1 || sub.SubTraces[0].Name != "ns.dns.org." || sub.SubTraces[0].ParentStep != 1 {
+		t.Fatalf("expected a nested sub-trace for ns.dns.org., got %#v", sub.SubTraces)
+	}
+	if len(sub.SubTraces[0].TraceSteps) != 2 {
+		t.Fatalf("expected the ns.dns.org. lookup steps to be recorded, got %d", len(sub.SubTraces[0].TraceSteps))
+	}
+}
+
+func subTraceSteps(subTraces []model.SubTrace) []model.TraceStep {
+	steps := []model.TraceStep{}
+	for _, sub := range subTraces {
+		steps = append(steps, sub.TraceSteps...)
+		steps = append(steps, subTraceSteps(sub.SubTraces)...)
+	}
+	return steps
+}
+
+func dependencyResponder(glue bool) func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		ns := func(zone string, hosts ...string) {
+			for _, host := range hosts {
+				resp.Ns = append(resp.Ns, &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: host})
+			}
+		}
+		addr := func(host, ip string) {
+			resp.Extra = append(resp.Extra, &dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(ip)})
+		}
+		switch server {
+		case "1.1.1.1:53":
+			tld := dns.SplitDomainName(q.Name)
+			ns(tld[len(tld)-1]+".", "a.gtld.")
+			addr("a.gtld.", "192.0.2.1")
+		case "192.0.2.1:53":
+			switch {
+			case dns.IsSubDomain("example.com.", q.Name):
+				ns("example.com.", "ns1.dns.net.", "ns2.dns.net.")
+			case dns.IsSubDomain("dns.net.", q.Name) && glue:
+				ns("dns.net.", "ns.dns.net.")
+				addr("ns.dns.net.", "192.0.2.3")
+			case dns.IsSubDomain("dns.net.", q.Name):
+				ns("dns.net.", "ns.example.com.")
+			}
+		case "192.0.2.3:53":
+			resp.Authoritative = true
+			ip := map[string]string{"ns1.dns.net.": "192.0.2.53", "ns2.dns.net.": "192.0.2.54"}[q.Name]
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}}
+		case "192.0.2.53:53", "192.0.2.54:53":
+			resp.Authoritative = true
+			resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}
+}
+
+func TestTraceCheckDependencies(t *testing.T) {
+	cases := []struct {
+		name  string
+		glue  bool
+		class string
+		hints []string
+	}{
+		{
+			name:  "single provider",
+			glue:  true,
+			class: "FRAGILE_NS_DEPENDENCIES",
+			hints: []string{
+				"example.com.: every nameserver is under dns.net., a single provider",
+				"dns.net.: every nameserver is under dns.net., a single provider",
+			},
+		},
+		{
+			name:  "cycle",
+			class: "BROKEN_DELEGATION",
+			hints: []string{
+				"nameserver dependency cycle example.com. -> dns.net. -> example.com.: each zone needs the next to resolve its nameservers",
+				"example.com.: every nameserver is under dns.net., a single provider",
+				"dns.net.: every nameserver is under example.com., a single provider",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &dnsclient.MockTransport{Responder: dependencyResponder(tc.glue)}
+			client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+			tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4, CheckDependencies: true})
+			tracer.rootHints = []string{"1.1.1.1:53"}
+
+			result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+			if err != nil {
+				t.Fatalf("trace error: %v", err)
+			}
+			if result.Diagnosis.Classification != tc.class {
+				t.Fatalf("expected %s, got %s: %s", tc.class, result.Diagnosis.Classification, result.Diagnosis.Summary)
+			}
+			for _, want := range tc.hints {
+				found := false
+				for _, hint := range result.Diagnosis.Hints {
+					if hint == want {
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("expected hint %q, got %#v", want, result.Diagnosis.Hints)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceStopsNameserverLookupCycles(t *testing.T) {
+	transport := &dnsclient.MockTransport{Responder: dependencyResponder(false)}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "BROKEN_DELEGATION" {
+		t.Fatalf("expected BROKEN_DELEGATION, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	var errs []string
+	var collect func(subs []model.SubTrace)
+	collect = func(subs []model.SubTrace) {
+		for _, sub := range subs {
+			errs = append(errs, sub.Error)
+			collect(sub.SubTraces)
+		}
+	}
+	collect(result.SubTraces)
+	want := "nameserver dependency cycle example.com. -> dns.net. -> example.com."
+	found := false
+	for _, text := range errs {
+		if text == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected a sub-trace to stop at the cycle, got %#v", errs)
+	}
+}
+
+func TestTraceBoundsNameserverLookups(t *testing.T) {
+	queries := 0
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		queries++
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		labels := dns.SplitDomainName(q.Name)
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "a.test."}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")}}
+		case "192.0.2.1:53":
+			// zN.test. is served by ns.zN+1.test., without glue and without end.
+			zone := labels[len(labels)-2]
+			var n int
+			fmt.Sscanf(zone, "z%d", &n)
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: zone + ".test.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: fmt.Sprintf("ns.z%d.test.", n+1)}}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.Trace(context.Background(), "www.z0.test", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "BROKEN_DELEGATION" {
+		t.Fatalf("expected BROKEN_DELEGATION, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+	if queries > 4*maxNameserverLookups {
+		t.Fatalf("expected the lookup budget to bound queries, got %d", queries)
+	}
+	sub := result.SubTraces[0]
+	for len(sub.SubTraces) > 0 {
+		sub = sub.SubTraces[0]
+	}
+	if sub.Error != fmt.Sprintf("nameserver lookup budget of %d exhausted", maxNameserverLookups) {
+		t.Fatalf("expected the deepest lookup to hit the budget, got %q", sub.Error)
+	}
+}
+
+func TestTraceCheckDependenciesStartsFresh(t *testing.T) {
+	cyclic := true
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		resp, rtt, err := dependencyResponder(!cyclic)(server, msg)
+		if err == nil && !cyclic && server == "192.0.2.1:53" && dns.IsSubDomain("example.com.", msg.Question[0].Name) {
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.dns.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP("192.0.2.53")}}
+		}
+		return resp, rtt, err
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 8, MaxTime: time.Second, Parallelism: 1, Family: FamilyIPv4, CheckDependencies: true})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	if _, err := tracer.Trace(context.Background(), "www.example.com", "A"); err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	cyclic = false
+	result, err := tracer.Trace(context.Background(), "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	for _, hint := range result.Diagnosis.Hints {
+		if strings.Contains(hint, "cycle") {
+			t.Fatalf("expected no cycle from the earlier trace, got %#v", result.Diagnosis.Hints)
+		}
+	}
+}
+
+func TestDependencyConcentration(t *testing.T) {
+	cases := []struct {
+		name        string
+		zone        string
+		nameservers []string
+		want        string
+	}{
+		{name: "root name", zone: "example.com.", nameservers: []string{".", ""}},
+		{name: "tld", zone: "com.", nameservers: []string{"a.gtld-servers.net.", "b.gtld-servers.net."}},
+		{name: "registrable domain", zone: "example.org.", nameservers: []string{"ns1.eu.dns.co.uk.", "ns2.us.dns.co.uk."}, want: "example.org.: every nameserver is under dns.co.uk., a single provider"},
+		{name: "one tld", zone: "example.org.", nameservers: []string{"ns1.dns-a.net.", "ns1.dns-b.net."}, want: "example.org.: every nameserver is under the .net TLD"},
+		{name: "spread", zone: "example.org.", nameservers: []string{"ns1.dns-a.net.", "ns1.dns-b.org."}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := concentration(tc.zone, tc.nameservers); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDNSSECChainCloneIsIndependent(t *testing.T) {
+	chain := &dnssecChain{status: chainSecure, keys: map[string][]*dns.DNSKEY{".": {}}}
+	chain.cut(".").steps = []int{0}
+
+	copied := chain.clone()
+	copied.fail(chainBogus, "example.com.", "bad signature", 3)
+	copied.warnings = append(copied.warnings, "warning")
+	copied.keys["example.com."] = []*dns.DNSKEY{{}}
+	copied.cut(".").steps = append(copied.cut(".").steps, 1)
+	copied.cut("com.")
+
+	if chain.status != chainSecure || len(chain.evidence) != 0 || len(chain.warnings) != 0 {
+		t.Fatalf("expected the original chain to stay secure, got %#v", chain)
+	}
+	if len(chain.keys) != 1 || len(chain.cuts) != 1 || len(chain.cut(".").steps) != 1 {
+		t.Fatalf("expected the original keys and cuts unchanged, got %#v %#v", chain.keys, chain.cuts)
+	}
+}
+
+func TestTraceTypesQueriesFinalServers(t *testing.T) {
+	queries := map[string]int{}
+	var mu sync.Mutex
+	transport := &dnsclient.MockTransport{Responder: func(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+		mu.Lock()
+		queries[server]++
+		mu.Unlock()
+		q := msg.Question[0]
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		switch server {
+		case "1.1.1.1:53":
+			resp.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com."}}
+			resp.Extra = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")}}
+		case "192.0.2.53:53":
+			resp.Authoritative = true
+			switch q.Qtype {
+			case dns.TypeA:
+				resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.10")}}
+			case dns.TypeMX:
+				resp.Answer = []dns.RR{&dns.MX{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60}, Preference: 10, Mx: "mail.example.com."}}
+			case dns.TypeTXT:
+				resp.Authoritative = false
+				resp.Rcode = dns.RcodeServerFailure
+			default:
+				resp.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1.example.com.", Mbox: "hostmaster.example.com.", Serial: 1, Minttl: 60}}
+			}
+		default:
+			return nil, 0, errors.New("unexpected server " + server)
+		}
+		return resp, time.Millisecond, nil
+	}}
+	client := dnsclient.NewWithTransports(dnsclient.Options{Mode: dnsclient.ModeUDP, Timeout: time.Second}, transport, transport)
+	tracer := NewTracer(client, Config{MaxHops: 5, MaxTime: time.Second, Parallelism: 1})
+	tracer.rootHints = []string{"1.1.1.1:53"}
+
+	result, err := tracer.TraceTypes(context.Background(), "example.com", []string{"A", "MX", "CAA"})
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if queries["1.1.1.1:53"] != 1 {
+		t.Fatalf("expected the delegation to be traced once, got %v", queries)
+	}
+	if len(result.Types) != 3 {
+		t.Fatalf("expected three type results, got %#v", result.Types)
+	}
+	want := map[string]string{"A": "SUCCESS", "MX": "SUCCESS", "CAA": "NODATA"}
+	for _, typeResult := range result.Types {
+		if typeResult.Diagnosis.Classification != want[typeResult.QueryType] {
+			t.Fatalf("unexpected %s result %+v", typeResult.QueryType, typeResult)
+		}
+		if typeResult.Step < 0 || result.TraceSteps[typeResult.Step].QueryType != typeResult.QueryType {
+			t.Fatalf("expected %s to link to its query step, got %d", typeResult.QueryType, typeResult.Step)
+		}
+	}
+	if result.Diagnosis.Classification != "SUCCESS" || result.Diagnosis.Summary != "authoritative answers for A, MX; no data for CAA" {
+		t.Fatalf("unexpected diagnosis %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+
+	result, err = tracer.TraceTypes(context.Background(), "example.com", []string{"A", "TXT"})
+	if err != nil {
+		t.Fatalf("trace error: %v", err)
+	}
+	if result.Diagnosis.Classification != "SERVFAIL_TIMEOUT" || result.Diagnosis.Summary != "TXT: SERVFAIL" {
+		t.Fatalf("expected the failing type to name the diagnosis, got %s: %s", result.Diagnosis.Classification, result.Diagnosis.Summary)
+	}
+}
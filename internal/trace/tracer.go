@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 	"sort"
 	"strings"
 	"sync"
@@ -16,18 +18,61 @@ import (
 	"go.uber.org/zap"
 )
 
+type Family string
+
+const (
+	FamilyAny  Family = ""
+	FamilyIPv4 Family = "ipv4"
+	FamilyIPv6 Family = "ipv6"
+)
+
 type Config struct {
 	MaxHops     int
 	MaxTime     time.Duration
 	Parallelism int
-	Logger      *zap.Logger
-	Verbose     bool
+	Family      Family
+	DNSSEC      bool
+	// RootHints and TrustAnchors replace the built-in root servers and root
+	// KSK digests when set.
+	RootHints    RootHints
+	TrustAnchors []*dns.DS
+	// Prime sends a ". NS" priming query before the first hop and warns when
+	// the answer differs from the root hints.
+	Prime bool
+	// QNameMin sends minimised NS queries (RFC 9156) one label at a time and
+	// reports servers that mishandle them.
+	QNameMin bool
+	// CheckDelegation compares each referral's NS set and glue with the
+	// child zone's own records after the trace.
+	CheckDelegation bool
+	// CheckSOA compares the SOA served by every address of every nameserver
+	// for the final zone.
+	CheckSOA bool
+	// CheckLame classifies every nameserver address of the final zone as
+	// authoritative, lame, unreachable or serving the wrong zone.
+	CheckLame bool
+	// Fallback keeps going with a zone's other nameservers and address
+	// families when a hop fails, as a resolver would, instead of stopping.
+	Fallback bool
+	// CheckDependencies follows the zones that hold each zone's nameservers
+	// and reports cycles and single provider or TLD dependencies.
+	CheckDependencies bool
+	Logger            *zap.Logger
+	Verbose           bool
 }
 
 type Tracer struct {
-	client    *dnsclient.Client
-	config    Config
-	rootHints []string
+	client     *dnsclient.Client
+	config     Config
+	rootHints  []string
+	rootHints6 []string
+	rootNames  map[string]string
+	// configuredHints are the root hints before any priming, which every
+	// priming answer is compared against.
+	configuredHints RootHints
+	trustAnchors    []*dns.DS
+	cache           *cache
+	deps            *dependencies
 }
 
 type response struct {
@@ -37,6 +82,7 @@ type response struct {
 	transport string
 	err       error
 	stepIndex int
+	cookie    string
 }
 
 func NewTracer(client *dnsclient.Client, cfg Config) *Tracer {
@@ -52,53 +98,137 @@ func NewTracer(client *dnsclient.Client, cfg Config) *Tracer {
 	if cfg.Logger == nil {
 		cfg.Logger = zap.NewNop()
 	}
-	return &Tracer{client: client, config: cfg, rootHints: DefaultRootHints}
+	tracer := &Tracer{client: client, config: cfg, rootHints: DefaultRootHints, rootHints6: DefaultRootHints6, rootNames: DefaultRootHintNames, trustAnchors: DefaultTrustAnchors, cache: newCache()}
+	if !cfg.RootHints.empty() {
+		tracer.setRootHints(cfg.RootHints)
+	}
+	tracer.configuredHints = RootHints{IPv4: tracer.rootHints, IPv6: tracer.rootHints6, Names: tracer.rootNames}
+	if len(cfg.TrustAnchors) > 0 {
+		tracer.trustAnchors = cfg.TrustAnchors
+	}
+	return tracer
 }
 
 func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.TraceResult, error) {
+	result, _, err := t.run().trace(ctx, fqdn, rrtype, nil)
+	return result, err
+}
+
+// run returns a copy of t with an empty dependency graph, so that a trace
+// only reports the nameserver dependencies it saw itself.
+func (t *Tracer) run() *Tracer {
+	run := *t
+	run.deps = newDependencies()
+	return &run
+}
+
+// trace runs the walk and the checks configured for it. When end is set it
+// receives the name, zone and servers the walk stopped at.
+func (t *Tracer) trace(ctx context.Context, fqdn string, rrtype string, end *walkEnd) (model.TraceResult, *dnssecChain, error) {
 	qtype, ok := dns.StringToType[strings.ToUpper(rrtype)]
 	if !ok {
-		return model.TraceResult{}, fmt.Errorf("unsupported rrtype: %s", rrtype)
+		return model.TraceResult{}, nil, fmt.Errorf("unsupported rrtype: %s", rrtype)
 	}
 
-	name := dns.Fqdn(fqdn)
-	servers := append([]string{}, t.rootHints...)
-	serverLabels := map[string]string{}
-	for addr, name := range DefaultRootHintNames {
-		serverLabels[addr] = name
+	result := model.TraceResult{}
+	var warnings []string
+	if t.config.Prime {
+		warnings = t.prime(ctx, &result)
+	}
+	var qmin *minimisation
+	if t.config.QNameMin {
+		qmin = newMinimisation()
+	}
+	var checks *delegationChecks
+	if t.config.CheckDelegation {
+		checks = &delegationChecks{}
+	}
+	chain := t.walk(ctx, dns.Fqdn(fqdn), qtype, qmin, checks, &result, end)
+	final := latestStepIndex(result.TraceSteps)
+	result.Diagnosis = qmin.diagnose(result.Diagnosis)
+	issues := t.checkDelegations(ctx, checks, &result)
+	if (t.config.CheckSOA || t.config.CheckLame) && final >= 0 && result.TraceSteps[final].Error == "" {
+		probe := t.probeZone(ctx, result.TraceSteps[final], &result)
+		var found []consistencyIssue
+		if t.config.CheckLame {
+			result.Nameservers, found = checkNameservers(probe)
+			issues = append(issues, found...)
+		}
+		if t.config.CheckSOA {
+			result.SOA, found = checkSOA(probe)
+			issues = append(issues, found...)
+		}
+	}
+	if t.config.CheckDependencies {
+		issues = append(issues, t.checkDependencies(ctx, dns.Fqdn(fqdn), &result)...)
 	}
+	result.Diagnosis = consistencyDiagnosis(result.Diagnosis, issues)
+	result.Diagnosis.Warnings = append(result.Diagnosis.Warnings, warnings...)
+	return result, chain, nil
+}
+
+// walk follows referrals from the root to an answer for name, recording each
+// hop and the final diagnosis in result. With qmin set, each zone is asked
+// for one more label of name at a time; with checks set, every referral is
+// kept for the parent/child comparison.
+func (t *Tracer) walk(ctx context.Context, name string, qtype uint16, qmin *minimisation, checks *delegationChecks, result *model.TraceResult, end *walkEnd) *dnssecChain {
+	servers := t.startServers()
+	serverLabels := t.rootLabels()
+	zone := "."
 	visited := map[string]bool{}
+	known := newZoneServers(nil)
+	abandoned := []string{}
+	defer func() {
+		result.Diagnosis.Warnings = append(result.Diagnosis.Warnings, abandoned...)
+		if end != nil {
+			*end = walkEnd{step: latestStepIndex(result.TraceSteps), name: name, zone: zone, servers: servers, labels: serverLabels}
+		}
+	}()
 
-	result := model.TraceResult{}
+	var chain *dnssecChain
+	if t.config.DNSSEC {
+		chain = t.startChain(ctx, servers, result, serverLabels)
+	}
 
 	for hop := 0; hop < t.config.MaxHops; hop++ {
-		responses := t.queryServers(ctx, servers, name, qtype, &result, t.config.Verbose, serverLabels)
-		best := selectBest(responses, qtype)
+		qname, qt := qmin.next(name, qtype, zone)
+		known.mark(servers)
+		responses := t.queryServers(ctx, servers, qname, qt, zone, result, t.config.Verbose, serverLabels)
+		best := selectBest(responses, qt)
+		// retry moves on to the zone's untried nameservers in fallback mode.
+		retry := func(best *response) bool {
+			if !t.config.Fallback {
+				return false
+			}
+			next, labels, found := t.fallback(ctx, zone, known, responses, best, qname, qt, serverLabels, result)
+			abandoned = append(abandoned, found...)
+			if len(next) == 0 {
+				return false
+			}
+			servers, serverLabels = next, labels
+			return true
+		}
 		if best == nil {
+			if retry(nil) {
+				continue
+			}
+			hints := []string{"check network reachability or nameserver availability"}
+			if len(servers) == 0 && t.config.Family != FamilyAny {
+				hints = []string{fmt.Sprintf("no %s nameserver addresses for %s", t.config.Family, zone)}
+			}
 			outcome := analyze.Outcome{
 				Kind:         analyze.OutcomeServfailTimeout,
 				Summary:      "no reachable nameservers for delegation",
 				EvidenceStep: latestStepIndex(result.TraceSteps),
-				Hints:        []string{"check network reachability or nameserver availability"},
+				Hints:        hints,
 			}
 			result.Diagnosis = analyze.Diagnose(outcome)
-			return result, nil
-		}
-
-		if best.err != nil {
-			outcome := analyze.Outcome{
-				Kind:         analyze.OutcomeServfailTimeout,
-				Summary:      best.err.Error(),
-				EvidenceStep: best.stepIndex,
-				Hints:        []string{"retry with --transport tcp", "verify nameserver reachability"},
-			}
-			result.Diagnosis = analyze.Diagnose(outcome)
-			return result, nil
+			return chain
 		}
 
 		if !t.config.Verbose {
 			stepIndex := len(result.TraceSteps)
-			step := buildStep(stepIndex, name, qtype, *best, serverLabels)
+			step := buildStep(stepIndex, qname, qt, zone, *best, serverLabels)
 			step.Note = summarizeResponses(responses)
 			if best.resp != nil && hasDelegation(best.resp) {
 				_, zone := nsNamesAndZone(best.resp)
@@ -112,15 +242,13 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 		}
 
 		resp := best.resp
-		if resp == nil {
-			outcome := analyze.Outcome{
-				Kind:         analyze.OutcomeServfailTimeout,
-				Summary:      "empty response from nameserver",
-				EvidenceStep: best.stepIndex,
-				Hints:        []string{"retry with --transport tcp"},
+
+		if qname != name {
+			qmin.checkServers(responses, best, qname, serverLabels)
+			if !isReferral(resp) {
+				zone = t.minimised(ctx, qmin, chain, best, qname, zone, servers, serverLabels, result)
+				continue
 			}
-			result.Diagnosis = analyze.Diagnose(outcome)
-			return result, nil
 		}
 
 		if resp.Rcode == dns.RcodeNameError && resp.Authoritative {
@@ -129,8 +257,9 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 				Summary:      "authoritative NXDOMAIN",
 				EvidenceStep: best.stepIndex,
 			}
-			result.Diagnosis = analyze.Diagnose(outcome)
-			return result, nil
+			t.checkResponse(chain, resp, zone, best.stepIndex, result)
+			result.Diagnosis = analyze.Diagnose(dnssecOutcome(chain, outcome))
+			return chain
 		}
 
 		if resp.Rcode == dns.RcodeSuccess {
@@ -140,8 +269,9 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 					Summary:      "authoritative answer returned",
 					EvidenceStep: best.stepIndex,
 				}
-				result.Diagnosis = analyze.Diagnose(outcome)
-				return result, nil
+				t.checkResponse(chain, resp, zone, best.stepIndex, result)
+				result.Diagnosis = analyze.Diagnose(dnssecOutcome(chain, outcome))
+				return chain
 			}
 
 			if cname := firstCNAME(resp); cname != nil {
@@ -153,9 +283,10 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 						Hints:        []string{"verify CNAME chain"},
 					}
 					result.Diagnosis = analyze.Diagnose(outcome)
-					return result, nil
+					return chain
 				}
 				visited[cname.Target] = true
+				t.checkResponse(chain, resp, zone, best.stepIndex, result)
 				name = dns.Fqdn(cname.Target)
 				continue
 			}
@@ -169,7 +300,7 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 						EvidenceStep: best.stepIndex,
 					}
 					result.Diagnosis = analyze.Diagnose(outcome)
-					return result, nil
+					return chain
 				}
 				if visited[newName] {
 					outcome := analyze.Outcome{
@@ -179,9 +310,10 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 						Hints:        []string{"verify DNAME chain"},
 					}
 					result.Diagnosis = analyze.Diagnose(outcome)
-					return result, nil
+					return chain
 				}
 				visited[newName] = true
+				t.checkResponse(chain, resp, zone, best.stepIndex, result)
 				name = dns.Fqdn(newName)
 				continue
 			}
@@ -192,31 +324,45 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 					Summary:      "authoritative no data for RRtype",
 					EvidenceStep: best.stepIndex,
 				}
-				result.Diagnosis = analyze.Diagnose(outcome)
-				return result, nil
+				t.checkResponse(chain, resp, zone, best.stepIndex, result)
+				result.Diagnosis = analyze.Diagnose(dnssecOutcome(chain, outcome))
+				return chain
 			}
 
 			if hasDelegation(resp) {
-				nextServers := extractGlueServers(resp)
+				nextServers := t.filterFamily(extractGlueServers(resp))
 				nextLabels := extractGlueLabels(resp)
+				nsNames, nextZone := nsNamesAndZone(resp)
+				t.deps.referral(nextZone, nsNames)
 				if len(nextServers) == 0 {
-					nsNames, zone := nsNamesAndZone(resp)
-					inBailiwick, outOfBailiwick := splitBailiwick(nsNames, zone)
+					inBailiwick, outOfBailiwick := splitBailiwick(nsNames, nextZone)
 					resolved := []string{}
 					var err error
 					if len(outOfBailiwick) > 0 {
-						resolved, err = t.resolveNameserverAddresses(ctx, outOfBailiwick, &result, 0, t.config.Verbose)
+						resolved, err = t.resolveNameserverAddresses(ctx, nextZone, outOfBailiwick, result)
 					}
 					if err == nil && len(resolved) > 0 {
+						checks.add(nextZone, resp, resolved, nextLabels)
+						t.cache.storeDelegation(nextZone, resp, resolved, nextLabels, best.server)
+						known = newZoneServers(nsNames)
+						if chain != nil {
+							t.extendChain(ctx, chain, zone, servers, serverLabels, nextZone, resolved, nextLabels, result)
+						}
 						servers = resolved
+						zone = nextZone
 						if len(nextLabels) > 0 {
 							serverLabels = nextLabels
 						}
 						continue
 					}
+					if retry(best) {
+						continue
+					}
 
 					hints := []string{}
-					if len(inBailiwick) > 0 {
+					if len(inBailiwick) > 0 && t.config.Family != FamilyAny && len(extractGlueServers(resp)) > 0 {
+						hints = append(hints, fmt.Sprintf("no %s glue for in-bailiwick nameservers", t.config.Family))
+					} else if len(inBailiwick) > 0 {
 						hints = append(hints, "missing glue records for in-bailiwick nameservers")
 					}
 					if len(outOfBailiwick) > 0 {
@@ -229,9 +375,16 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 						Hints:        hints,
 					}
 					result.Diagnosis = analyze.Diagnose(outcome)
-					return result, nil
+					return chain
+				}
+				checks.add(nextZone, resp, nextServers, nextLabels)
+				t.cache.storeDelegation(nextZone, resp, extractGlueServers(resp), nextLabels, best.server)
+				known = newZoneServers(nsNames)
+				if chain != nil {
+					t.extendChain(ctx, chain, zone, servers, serverLabels, nextZone, nextServers, nextLabels, result)
 				}
 				servers = nextServers
+				zone = nextZone
 				if len(nextLabels) > 0 {
 					serverLabels = nextLabels
 				}
@@ -239,6 +392,9 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 			}
 
 			if !resp.Authoritative {
+				if retry(best) {
+					continue
+				}
 				outcome := analyze.Outcome{
 					Kind:         analyze.OutcomeLameDelegation,
 					Summary:      "nameserver not authoritative for zone",
@@ -246,11 +402,14 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 					Hints:        []string{"verify NS delegation and authoritative configuration"},
 				}
 				result.Diagnosis = analyze.Diagnose(outcome)
-				return result, nil
+				return chain
 			}
 		}
 
 		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			if retry(best) {
+				continue
+			}
 			outcome := analyze.Outcome{
 				Kind:         analyze.OutcomeServfailTimeout,
 				Summary:      dns.RcodeToString[resp.Rcode],
@@ -258,7 +417,7 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 				Hints:        []string{"check authoritative server health"},
 			}
 			result.Diagnosis = analyze.Diagnose(outcome)
-			return result, nil
+			return chain
 		}
 	}
 
@@ -269,22 +428,27 @@ func (t *Tracer) Trace(ctx context.Context, fqdn string, rrtype string) (model.T
 		Hints:        []string{"increase --max-hops", "check for CNAME loops"},
 	}
 	result.Diagnosis = analyze.Diagnose(outcome)
-	return result, nil
+	return chain
 }
 
-func (t *Tracer) resolveNameserverAddresses(ctx context.Context, names []string, result *model.TraceResult, depth int, record bool) ([]string, error) {
-	if depth > 4 {
-		return nil, fmt.Errorf("nameserver resolution depth exceeded")
+// resolveNameserverAddresses looks up the addresses of nameservers, recording
+// each lookup as a sub-trace of the latest step in result. When zone is set
+// the names are the nameservers delegated to it, and a lookup that needs
+// zone's nameservers again is a dependency cycle and fails.
+func (t *Tracer) resolveNameserverAddresses(ctx context.Context, zone string, names []string, result *model.TraceResult) ([]string, error) {
+	if zone != "" {
+		if err := t.deps.enter(zone); err != nil {
+			return nil, err
+		}
+		defer t.deps.leave()
 	}
 	addresses := []string{}
 	for _, name := range names {
-		aAddrs, err := t.resolveHost(ctx, name, dns.TypeA, result, depth, record)
-		if err == nil {
-			addresses = append(addresses, aAddrs...)
-		}
-		aaaaAddrs, err := t.resolveHost(ctx, name, dns.TypeAAAA, result, depth, record)
-		if err == nil {
-			addresses = append(addresses, aaaaAddrs...)
+		for _, qtype := range t.addressTypes() {
+			addrs, err := t.subTrace(ctx, name, qtype, result)
+			if err == nil {
+				addresses = append(addresses, addrs...)
+			}
 		}
 	}
 	addresses = uniqueStrings(addresses)
@@ -294,27 +458,62 @@ func (t *Tracer) resolveNameserverAddresses(ctx context.Context, names []string,
 	return addresses, nil
 }
 
-func (t *Tracer) resolveHost(ctx context.Context, name string, qtype uint16, result *model.TraceResult, depth int, record bool) ([]string, error) {
+// subTrace resolves one nameserver address record into its own trace, linked
+// to the step that needed it.
+func (t *Tracer) subTrace(ctx context.Context, name string, qtype uint16, result *model.TraceResult) ([]string, error) {
+	lookup := model.TraceResult{}
+	var addrs []string
+	err := t.deps.spend()
+	if err == nil {
+		addrs, err = t.resolveHost(ctx, name, qtype, &lookup)
+	}
+	sub := model.SubTrace{
+		ParentStep: latestStepIndex(result.TraceSteps),
+		Name:       dns.Fqdn(name),
+		QueryType:  dns.TypeToString[qtype],
+		Addresses:  addrs,
+		TraceSteps: lookup.TraceSteps,
+		SubTraces:  lookup.SubTraces,
+	}
+	if err != nil {
+		sub.Error = err.Error()
+	}
+	result.SubTraces = append(result.SubTraces, sub)
+	mergeCookies(result, lookup.Cookies)
+	return addrs, err
+}
+
+func (t *Tracer) resolveHost(ctx context.Context, name string, qtype uint16, result *model.TraceResult) ([]string, error) {
 	name = dns.Fqdn(name)
-	servers := append([]string{}, t.rootHints...)
-	serverLabels := map[string]string{}
-	for addr, label := range DefaultRootHintNames {
-		serverLabels[addr] = label
+	query := name
+	if entry, ok := t.cache.answer(query, qtype); ok {
+		cachedStep(result, query, qtype, entry.zone, entry.source, nil, entry.resp, nil, "")
+		return cachedAddresses(entry.resp, query, qtype)
+	}
+	servers := t.startServers()
+	serverLabels := t.rootLabels()
+	zone := "."
+	if entry, ok := t.cache.delegation(name, t.filterFamily); ok {
+		cachedStep(result, name, qtype, ".", entry.source, nil, nil, entry.ns, "referral="+entry.zone)
+		servers, serverLabels, zone = entry.servers, entry.labels, entry.zone
 	}
 	visited := map[string]bool{}
 
 	for hop := 0; hop < t.config.MaxHops; hop++ {
-		responses := t.queryServers(ctx, servers, name, qtype, result, record, serverLabels)
-		best := selectBest(responses, qtype)
+		best, _ := t.queryRecorded(ctx, servers, name, qtype, zone, result, serverLabels)
 		if best == nil || best.resp == nil || best.err != nil {
 			return nil, fmt.Errorf("no reachable nameservers for %s", name)
 		}
 		resp := best.resp
 		if resp.Rcode == dns.RcodeNameError && resp.Authoritative {
+			t.deps.host(name, zone)
+			t.cache.storeAnswer(query, qtype, resp, zone, best.server)
 			return nil, fmt.Errorf("nxdomain for %s", name)
 		}
 		if resp.Rcode == dns.RcodeSuccess {
 			if resp.Authoritative && hasAnswerType(resp, qtype) {
+				t.deps.host(name, zone)
+				t.cache.storeAnswer(query, qtype, resp, zone, best.server)
 				return extractAddresses(resp, qtype), nil
 			}
 			if cname := firstCNAME(resp); cname != nil {
@@ -337,29 +536,40 @@ func (t *Tracer) resolveHost(ctx context.Context, name string, qtype uint16, res
 				name = dns.Fqdn(newName)
 				continue
 			}
-			if hasDelegation(resp) {
-				nextServers := extractGlueServers(resp)
+			if hasDelegation(resp) && !resp.Authoritative {
+				nextServers := t.filterFamily(extractGlueServers(resp))
 				nextLabels := extractGlueLabels(resp)
+				nsNames, nextZone := nsNamesAndZone(resp)
+				t.deps.referral(nextZone, nsNames)
+				t.deps.host(name, nextZone)
 				if len(nextServers) == 0 {
-					nsNames, zone := nsNamesAndZone(resp)
-					inBailiwick, outOfBailiwick := splitBailiwick(nsNames, zone)
+					inBailiwick, outOfBailiwick := splitBailiwick(nsNames, nextZone)
 					if len(outOfBailiwick) == 0 && len(inBailiwick) > 0 {
-						return nil, fmt.Errorf("delegation without glue for %s", zone)
+						return nil, fmt.Errorf("delegation without glue for %s", nextZone)
 					}
-					resolved, err := t.resolveNameserverAddresses(ctx, outOfBailiwick, result, depth+1, record)
+					resolved, err := t.resolveNameserverAddresses(ctx, nextZone, outOfBailiwick, result)
 					if err != nil {
 						return nil, err
 					}
+					t.cache.storeDelegation(nextZone, resp, resolved, nextLabels, best.server)
 					servers = resolved
+					zone = nextZone
 					serverLabels = nextLabels
 					continue
 				}
+				t.cache.storeDelegation(nextZone, resp, extractGlueServers(resp), nextLabels, best.server)
 				servers = nextServers
+				zone = nextZone
 				if len(nextLabels) > 0 {
 					serverLabels = nextLabels
 				}
 				continue
 			}
+			if resp.Authoritative && len(resp.Answer) == 0 {
+				t.deps.host(name, zone)
+				t.cache.storeAnswer(query, qtype, resp, zone, best.server)
+				return nil, fmt.Errorf("no %s records for %s", dns.TypeToString[qtype], name)
+			}
 		}
 		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
 			return nil, fmt.Errorf("server failure for %s", name)
@@ -368,7 +578,18 @@ func (t *Tracer) resolveHost(ctx context.Context, name string, qtype uint16, res
 	return nil, fmt.Errorf("max hops exceeded for %s", name)
 }
 
-func (t *Tracer) queryServers(ctx context.Context, servers []string, name string, qtype uint16, result *model.TraceResult, record bool, serverLabels map[string]string) []response {
+// cachedAddresses answers a nameserver lookup from a cached response.
+func cachedAddresses(resp *dns.Msg, name string, qtype uint16) ([]string, error) {
+	switch {
+	case resp.Rcode == dns.RcodeNameError:
+		return nil, fmt.Errorf("nxdomain for %s", name)
+	case hasAnswerType(resp, qtype):
+		return extractAddresses(resp, qtype), nil
+	}
+	return nil, fmt.Errorf("no %s records for %s", dns.TypeToString[qtype], name)
+}
+
+func (t *Tracer) queryServers(ctx context.Context, servers []string, name string, qtype uint16, zone string, result *model.TraceResult, record bool, serverLabels map[string]string) []response {
 	ctx, cancel := context.WithTimeout(ctx, t.config.MaxTime)
 	defer cancel()
 
@@ -384,12 +605,16 @@ func (t *Tracer) queryServers(ctx context.Context, servers []string, name string
 			defer func() { <-sem }()
 
 			msg := t.client.BuildQuery(name, qtype)
+			if opt := msg.IsEdns0(); opt != nil && t.config.DNSSEC {
+				opt.SetDo()
+			}
 			resp, rtt, transport, err := t.client.Exchange(ctx, srv, msg)
-			responses[idx] = response{server: srv, resp: resp, rtt: rtt, transport: transport, err: err}
+			responses[idx] = response{server: srv, resp: resp, rtt: rtt, transport: transport, err: err, cookie: dnsclient.CookieStatus(msg, resp)}
 		}(i, server)
 	}
 
 	wg.Wait()
+	recordCookies(result, responses, serverLabels)
 
 	if !record {
 		return responses
@@ -397,7 +622,7 @@ func (t *Tracer) queryServers(ctx context.Context, servers []string, name string
 
 	for i := range responses {
 		stepIndex := len(result.TraceSteps)
-		step := buildStep(stepIndex, name, qtype, responses[i], serverLabels)
+		step := buildStep(stepIndex, name, qtype, zone, responses[i], serverLabels)
 		result.TraceSteps = append(result.TraceSteps, step)
 		result.Timings = append(result.Timings, buildTiming(stepIndex, responses[i]))
 		responses[i].stepIndex = stepIndex
@@ -406,11 +631,40 @@ func (t *Tracer) queryServers(ctx context.Context, servers []string, name string
 	return responses
 }
 
-func buildStep(index int, name string, qtype uint16, resp response, serverLabels map[string]string) model.TraceStep {
+// queryRecorded queries servers and records a single summary step for the
+// best response, or every response in verbose mode. The step index is -1
+// when nothing was recorded.
+func (t *Tracer) queryRecorded(ctx context.Context, servers []string, name string, qtype uint16, zone string, result *model.TraceResult, serverLabels map[string]string) (*response, int) {
+	responses := t.queryServers(ctx, servers, name, qtype, zone, result, t.config.Verbose, serverLabels)
+	best := selectBest(responses, qtype)
+	if !t.config.Verbose && len(responses) > 0 {
+		recorded := responses[0]
+		if best != nil {
+			recorded = *best
+		}
+		stepIndex := len(result.TraceSteps)
+		step := buildStep(stepIndex, name, qtype, zone, recorded, serverLabels)
+		step.Note = summarizeResponses(responses)
+		result.TraceSteps = append(result.TraceSteps, step)
+		result.Timings = append(result.Timings, buildTiming(stepIndex, recorded))
+		if best != nil {
+			best.stepIndex = stepIndex
+		} else {
+			return nil, stepIndex
+		}
+	}
+	if best == nil {
+		return nil, latestStepIndex(result.TraceSteps)
+	}
+	return best, best.stepIndex
+}
+
+func buildStep(index int, name string, qtype uint16, zone string, resp response, serverLabels map[string]string) model.TraceStep {
 	step := model.TraceStep{
 		Index:         index,
 		Server:        resp.server,
 		ServerName:    serverLabels[resp.server],
+		Zone:          zone,
 		QueryName:     name,
 		QueryType:     dns.TypeToString[qtype],
 		Transport:     resp.transport,
@@ -430,9 +684,80 @@ func buildStep(index int, name string, qtype uint16, resp response, serverLabels
 	step.Answers = rrStrings(resp.resp.Answer)
 	step.NS = nsStrings(resp.resp.Ns)
 	step.SOA = soaString(resp.resp)
+	if subnet, scope, ok := dnsclient.ClientSubnetScope(resp.resp); ok {
+		step.ClientSubnet = subnet
+		step.ECSScope = &scope
+	}
+	step.NSID = dnsclient.NSID(resp.resp)
+	step.Cookie = resp.cookie
 	return step
 }
 
+// recordCookies folds per-query cookie results into one entry per server,
+// keeping the least compliant status seen.
+func recordCookies(result *model.TraceResult, responses []response, serverLabels map[string]string) {
+	for _, r := range responses {
+		if r.cookie == "" {
+			continue
+		}
+		found := false
+		for i := range result.Cookies {
+			check := &result.Cookies[i]
+			if check.Server != r.server {
+				continue
+			}
+			found = true
+			check.Queries++
+			if cookieRank(r.cookie) > cookieRank(check.Status) {
+				check.Status = r.cookie
+			}
+			if check.ServerName == "" {
+				check.ServerName = serverLabels[r.server]
+			}
+		}
+		if !found {
+			result.Cookies = append(result.Cookies, model.CookieCheck{
+				Server:     r.server,
+				ServerName: serverLabels[r.server],
+				Status:     r.cookie,
+				Queries:    1,
+			})
+		}
+	}
+}
+
+// mergeCookies folds cookie results from a sub-trace into result.
+func mergeCookies(result *model.TraceResult, checks []model.CookieCheck) {
+	for _, check := range checks {
+		found := false
+		for i := range result.Cookies {
+			existing := &result.Cookies[i]
+			if existing.Server != check.Server {
+				continue
+			}
+			found = true
+			existing.Queries += check.Queries
+			if cookieRank(check.Status) > cookieRank(existing.Status) {
+				existing.Status = check.Status
+			}
+		}
+		if !found {
+			result.Cookies = append(result.Cookies, check)
+		}
+	}
+}
+
+func cookieRank(status string) int {
+	switch status {
+	case dnsclient.CookieSupported:
+		return 0
+	case dnsclient.CookieIgnored:
+		return 1
+	default:
+		return 2
+	}
+}
+
 func buildTiming(index int, resp response) model.Timing {
 	timedOut := false
 	if resp.err != nil && errors.Is(resp.err, context.DeadlineExceeded) {
@@ -447,6 +772,62 @@ func buildTiming(index int, resp response) model.Timing {
 	}
 }
 
+func (t *Tracer) startServers() []string {
+	switch t.config.Family {
+	case FamilyIPv6:
+		return append([]string{}, t.rootHints6...)
+	case FamilyIPv4:
+		return t.filterFamily(t.rootHints)
+	default:
+		if len(t.rootHints) == 0 {
+			return append([]string{}, t.rootHints6...)
+		}
+		return append([]string{}, t.rootHints...)
+	}
+}
+
+func (t *Tracer) setRootHints(hints RootHints) {
+	t.rootHints = hints.IPv4
+	t.rootHints6 = hints.IPv6
+	t.rootNames = hints.Names
+}
+
+func (t *Tracer) rootLabels() map[string]string {
+	labels := map[string]string{}
+	for addr, name := range t.rootNames {
+		labels[addr] = name
+	}
+	return labels
+}
+
+func (t *Tracer) filterFamily(servers []string) []string {
+	if t.config.Family == FamilyAny {
+		return servers
+	}
+	out := []string{}
+	for _, server := range servers {
+		if serverFamily(server) == t.config.Family {
+			out = append(out, server)
+		}
+	}
+	return out
+}
+
+func serverFamily(server string) Family {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return FamilyAny
+	}
+	if addr.Unmap().Is4() {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
 func selectBest(responses []response, qtype uint16) *response {
 	valid := make([]response, 0, len(responses))
 	for _, r := range responses {
@@ -583,6 +964,10 @@ func rrStrings(rrs []dns.RR) []string {
 	return out
 }
 
+func isReferral(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeSuccess && !resp.Authoritative && len(resp.Answer) == 0 && hasDelegation(resp)
+}
+
 func hasDelegation(resp *dns.Msg) bool {
 	for _, rr := range resp.Ns {
 		if _, ok := rr.(*dns.NS); ok {